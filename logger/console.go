@@ -0,0 +1,59 @@
+// +build js,wasm
+
+package logger
+
+import (
+	"fmt"
+	"syscall/js"
+)
+
+// Console is a logger that writes to the js console.
+type Console struct {
+	// Entries below Level are discarded.
+	Level Level
+}
+
+// NewConsole constructor.
+func NewConsole(level Level) *Console {
+	return &Console{Level: level}
+}
+
+// Log writes the entry to the console method matching its level.
+func (c *Console) Log(level Level, msg string, fields ...Field) {
+	if level < c.Level {
+		return
+	}
+
+	method := "log"
+	switch level {
+	case LevelDebug:
+		method = "debug"
+	case LevelInfo:
+		method = "info"
+	case LevelWarn:
+		method = "warn"
+	case LevelError:
+		method = "error"
+	}
+
+	args := []interface{}{msg}
+	for _, f := range fields {
+		args = append(args, f.Key+"=", consoleValue(f.Value))
+	}
+	js.Global().Get("console").Call(method, args...)
+}
+
+// consoleValue passes js values to the console as they are
+// so they can be inspected and formats anything else.
+func consoleValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case js.Value:
+		return v
+	case interface{ JSValue() js.Value }:
+		return v.JSValue()
+	case error:
+		return v.Error()
+	default:
+		return fmt.Sprintf("%+v", v)
+	}
+}
@@ -0,0 +1,99 @@
+// Package logger provides a small leveled logger with structured fields.
+package logger
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Level is the severity of a log entry.
+type Level int
+
+// Log levels in increasing severity.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// String returns the name of the level.
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	default:
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+}
+
+// Field is a structured key-value pair attached to a log entry.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F creates a field.
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Logger logs messages with a level and structured fields.
+type Logger interface {
+	Log(level Level, msg string, fields ...Field)
+}
+
+// Nop is a logger that discards everything.
+type Nop struct{}
+
+// Log discards the entry.
+func (Nop) Log(Level, string, ...Field) {}
+
+var (
+	mu            sync.RWMutex
+	defaultLogger Logger = Nop{}
+)
+
+// SetDefault sets the logger used by the package level functions.
+// A nil logger disables logging.
+func SetDefault(l Logger) {
+	if l == nil {
+		l = Nop{}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	defaultLogger = l
+}
+
+// Default returns the default logger.
+func Default() Logger {
+	mu.RLock()
+	defer mu.RUnlock()
+	return defaultLogger
+}
+
+// Debug logs to the default logger.
+func Debug(msg string, fields ...Field) {
+	Default().Log(LevelDebug, msg, fields...)
+}
+
+// Info logs to the default logger.
+func Info(msg string, fields ...Field) {
+	Default().Log(LevelInfo, msg, fields...)
+}
+
+// Warn logs to the default logger.
+func Warn(msg string, fields ...Field) {
+	Default().Log(LevelWarn, msg, fields...)
+}
+
+// Error logs to the default logger.
+func Error(msg string, fields ...Field) {
+	Default().Log(LevelError, msg, fields...)
+}
@@ -0,0 +1,41 @@
+package logger_test
+
+import (
+	"github.com/mgnsk/jsutil/logger"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Logger", func() {
+	var rec *logger.Recorder
+
+	BeforeEach(func() {
+		rec = logger.NewRecorder()
+		logger.SetDefault(rec)
+	})
+
+	AfterEach(func() {
+		logger.SetDefault(nil)
+	})
+
+	It("records entries with levels and fields", func() {
+		logger.Debug("call done", logger.F("worker", 1))
+		logger.Error("port error", logger.F("event", "boom"))
+
+		entries := rec.Entries()
+		Expect(entries).To(HaveLen(2))
+		Expect(entries[0].Level).To(Equal(logger.LevelDebug))
+		Expect(entries[0].Msg).To(Equal("call done"))
+		worker, ok := entries[0].Field("worker")
+		Expect(ok).To(BeTrue())
+		Expect(worker).To(Equal(1))
+		Expect(entries[1].Level).To(Equal(logger.LevelError))
+	})
+
+	It("discards everything by default", func() {
+		logger.SetDefault(nil)
+		logger.Info("dropped")
+		Expect(logger.Default()).To(Equal(logger.Nop{}))
+		Expect(rec.Entries()).To(BeEmpty())
+	})
+})
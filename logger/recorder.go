@@ -0,0 +1,56 @@
+package logger
+
+import "sync"
+
+// Entry is a recorded log entry.
+type Entry struct {
+	Level  Level
+	Msg    string
+	Fields []Field
+}
+
+// Field returns the value of the first field with key.
+func (e Entry) Field(key string) (interface{}, bool) {
+	for _, f := range e.Fields {
+		if f.Key == key {
+			return f.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Recorder is a logger that keeps entries in memory for tests.
+type Recorder struct {
+	mu      sync.Mutex
+	entries []Entry
+}
+
+// NewRecorder constructor.
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+// Log records the entry.
+func (r *Recorder) Log(level Level, msg string, fields ...Field) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, Entry{
+		Level:  level,
+		Msg:    msg,
+		Fields: append([]Field(nil), fields...),
+	})
+}
+
+// Entries returns a copy of the recorded entries.
+func (r *Recorder) Entries() []Entry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Entry(nil), r.entries...)
+}
+
+// Reset discards the recorded entries.
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = nil
+}
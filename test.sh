@@ -13,6 +13,18 @@ go mod vendor
 # Fix to build ginkgo on js.
 sed -i 's/build windows/build windows js/g' ./vendor/github.com/onsi/ginkgo/internal/remote/output_interceptor_win.go
 
+# Packages that run without js.
+go test -mod=vendor -race -count=1 -v ./logger ./wrpc/...
+
+# The WebSocket specs of the js suite call a loopback server.
+go build -mod=vendor -o ./.tmp/loopback ./wrpc/wsserver/internal/loopback
+./.tmp/loopback > ./.tmp/loopback.url &
+trap 'kill $!' EXIT
+while [ ! -s ./.tmp/loopback.url ]; do sleep 0.1; done
+export WRPC_WS_URL="$(cat ./.tmp/loopback.url)"
+# Node 20 has WebSocket behind a flag.
+export NODE_OPTIONS=--experimental-websocket
+
 export GOOS=js
 export GOARCH=wasm
 go test -mod=vendor -count=1 -v -exec="$(go env GOROOT)/misc/wasm/go_js_wasm_exec" ./...
@@ -11,15 +11,23 @@ import (
 	"unsafe"
 
 	"github.com/davecgh/go-spew/spew"
+	"github.com/joomcode/errorx"
 )
 
 // IsWorker boolean
 var (
 	IsWorker bool
+	// IsNode is true when running in node instead of a browser.
+	IsNode bool
 )
 
 func init() {
-	IsWorker = js.Global().Get("WorkerGlobalScope").Type() != js.TypeUndefined
+	IsNode = js.Global().Get("process").Type() == js.TypeObject &&
+		js.Global().Get("process").Get("release").Get("name").String() == "node" &&
+		js.Global().Get("require").Type() == js.TypeFunction
+
+	IsWorker = js.Global().Get("WorkerGlobalScope").Type() != js.TypeUndefined ||
+		IsNode && !js.Global().Get("require").Invoke("worker_threads").Get("isMainThread").Bool()
 }
 
 // CreateURLObject creates an url object from javascript source.
@@ -28,6 +36,37 @@ func CreateURLObject(data interface{}, mime string) js.Value {
 	return js.Global().Get("URL").Call("createObjectURL", blob)
 }
 
+// Await blocks the calling goroutine until promise settles.
+// It returns the fulfilled value or an error with the rejection reason.
+func Await(promise js.Value) (js.Value, error) {
+	var (
+		value    js.Value
+		rejected bool
+	)
+	done := make(chan struct{})
+	onFulfilled := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		value = args[0]
+		close(done)
+		return nil
+	})
+	defer onFulfilled.Release()
+	onRejected := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		value = args[0]
+		rejected = true
+		close(done)
+		return nil
+	})
+	defer onRejected.Release()
+
+	js.Global().Get("Promise").Call("resolve", promise).Call("then", onFulfilled, onRejected)
+	<-done
+
+	if rejected {
+		return js.Undefined(), errorx.ExternalError.New("promise rejected: %s", js.Global().Get("String").Invoke(value).String())
+	}
+	return value, nil
+}
+
 // ConsoleLog console.log
 func ConsoleLog(args ...interface{}) {
 	js.Global().Get("console").Call("log", args...)
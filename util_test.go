@@ -3,6 +3,7 @@ package jsutil_test
 import (
 	"reflect"
 	"strings"
+	"syscall/js"
 
 	"github.com/mgnsk/jsutil"
 	. "github.com/onsi/ginkgo"
@@ -76,4 +77,19 @@ var _ = Describe("JSUtil", func() {
 			),
 		)
 	})
+
+	Context("Awaiting promises", func() {
+		It("returns the fulfilled value", func() {
+			v, err := jsutil.Await(js.Global().Get("Promise").Call("resolve", 42))
+			Expect(err).To(BeNil())
+			Expect(v.Int()).To(Equal(42))
+		})
+
+		It("returns the rejection reason as an error", func() {
+			reason := js.Global().Get("Error").New("boom")
+			_, err := jsutil.Await(js.Global().Get("Promise").Call("reject", reason))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("boom"))
+		})
+	})
 })
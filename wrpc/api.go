@@ -1,15 +1,19 @@
-// +build js,wasm
-
 package wrpc
 
 import (
 	"context"
 	"io"
 	"time"
+
+	"github.com/joomcode/errorx"
 )
 
+// readyTimeout specifies how long to wait for the remote end of an input pipe.
+const readyTimeout = 2 * time.Second
+
 // RemoteCall is a function which must be statically declared
 // so that it's pointer could be sent to another machine to run.
+// It must be registered with Register before it can be called.
 //
 // Arguments:
 // input is a reader which is piped into the worker's input.
@@ -18,17 +22,69 @@ import (
 // All writes to out block until a corresponding read from its other side.
 type RemoteCall func(in io.Reader, out io.WriteCloser)
 
+// CallOptions configures a remote call.
+type CallOptions struct {
+	// Shared values are passed to the call by reference,
+	// for example a Mutex to synchronize with other calls.
+	// The call can look them up with SharedValue.
+	Shared map[string]Shareable
+	// Compress compresses the input and output streams of the call,
+	// for example for large text or JSON. Small writes are not compressed.
+	Compress bool
+}
+
 // Go provides a familiar interface for wRPC calls.
 //
 // Here are some rules:
 // 1) f runs in a new goroutine on the first worker that receives it.
 // 2) f can call Go with a new RemoteCall.
+// 3) f must be registered with Register on every thread.
 // Workers can then act like a mesh where any chain of stream is concurrently active
-func Go(in io.Reader, out io.WriteCloser, f RemoteCall) {
+//
+// The returned Handle is done when the input and output are copied
+// and the call is scheduled. An empty input or output is valid.
+func Go(in io.Reader, out io.WriteCloser, f RemoteCall) *Handle {
+	return GoWith(in, out, f, CallOptions{})
+}
+
+// GoWith is like Go but with options.
+func GoWith(in io.Reader, out io.WriteCloser, f RemoteCall, opts CallOptions) *Handle {
+	h := newHandle()
+	defer h.seal()
+
 	if out == nil {
-		panic("Must have output")
+		h.fail(errorx.IllegalArgument.New("must have output"))
+		return h
+	}
+	if err := checkRegistered(f); err != nil {
+		h.fail(err)
+		return h
 	}
 
+	call := newCall(h, in, out, f, opts.Compress)
+	if len(opts.Shared) > 0 {
+		call.Shared = make(map[string]interface{}, len(opts.Shared))
+		for name, v := range opts.Shared {
+			call.Shared[name] = v
+		}
+	}
+
+	h.run(func() error {
+		// Schedule the call to first receiving worker.
+		if err := GlobalScheduler.Call(context.TODO(), call); err != nil {
+			return errorx.Decorate(err, "error scheduling call")
+		}
+		return nil
+	})
+
+	return h
+}
+
+// newCall creates a call with ports to in and out.
+// The goroutines copying in and out are run on h.
+// When compress is set, the input is compressed by this end
+// and the output by the worker.
+func newCall(h *Handle, in io.Reader, out io.WriteCloser, f RemoteCall, compress bool) Call {
 	var remoteReader, inputWriter, outputReader, remoteWriter *MessagePort
 
 	if p, ok := in.(*MessagePort); ok {
@@ -36,23 +92,21 @@ func Go(in io.Reader, out io.WriteCloser, f RemoteCall) {
 		remoteReader = p
 	} else if in != nil {
 		remoteReader, inputWriter = Pipe()
-		go func() {
-			ctx, cancel := context.WithTimeout(context.TODO(), 2*time.Second)
-			defer cancel()
+		inputWriter.SetCompression(compress)
+		h.run(func() error {
+			defer inputWriter.Close()
 
 			select {
 			case <-inputWriter.RemoteReady():
-			case <-ctx.Done():
-				panic("timeout waiting for inputWriter ready")
+			case <-time.After(readyTimeout):
+				return errorx.TimeoutElapsed.New("waited for input port ready in %s", readyTimeout)
 			}
 
-			defer inputWriter.Close()
-			if n, err := io.Copy(inputWriter, in); err != nil {
-				panic(err)
-			} else if n == 0 {
-				panic("0 write to inputWriter")
+			if _, err := io.Copy(inputWriter, in); err != nil {
+				return errorx.Decorate(err, "error copying input")
 			}
-		}()
+			return nil
+		})
 	}
 
 	if p, ok := out.(*MessagePort); ok {
@@ -60,42 +114,41 @@ func Go(in io.Reader, out io.WriteCloser, f RemoteCall) {
 		remoteWriter = p
 	} else {
 		outputReader, remoteWriter = Pipe()
-		go func() {
+		h.run(func() error {
 			defer out.Close()
-			if n, err := io.Copy(out, outputReader); err != nil {
-				panic(err)
-			} else if n == 0 {
-				panic("copy to outputReader: 0 bytes")
+			if _, err := io.Copy(out, outputReader); err != nil {
+				return errorx.Decorate(err, "error copying output")
 			}
-		}()
+			return nil
+		})
 	}
 
-	call := Call{
+	return Call{
 		RemoteCall: f,
 		Input:      remoteReader,
 		Output:     remoteWriter,
+		compress:   compress,
 	}
-
-	go func() {
-		// Schedule the call to first receiving worker.
-		if err := GlobalScheduler.Call(context.TODO(), call); err != nil {
-			panic(err)
-		}
-	}()
 }
 
 // GoChain runs goroutines in a chain, piping each worker's output into next input.
-func GoChain(in io.Reader, out io.WriteCloser, calls ...RemoteCall) {
+// The returned Handle is done when every call in the chain is done.
+func GoChain(in io.Reader, out io.WriteCloser, calls ...RemoteCall) *Handle {
+	h := newHandle()
+	defer h.seal()
+
 	prevOutReader := in
 	for i, f := range calls {
 		if i == len(calls)-1 {
 			// The last worker writes directly into out.
-			Go(prevOutReader, out, f)
+			h.join(Go(prevOutReader, out, f))
 
 		} else {
 			pipeReader, pipeWriter := Pipe()
-			Go(prevOutReader, pipeWriter, f)
+			h.join(Go(prevOutReader, pipeWriter, f))
 			prevOutReader = pipeReader
 		}
 	}
+
+	return h
 }
@@ -0,0 +1,149 @@
+// +build js,wasm
+
+package wrpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"syscall/js"
+
+	"github.com/joomcode/errorx"
+	"github.com/mgnsk/jsutil"
+)
+
+// Bootstrap generates the script that starts this binary in a worker.
+// SpawnWorker uses DefaultBootstrap when IndexJS is not set.
+//
+// The main thread compiles the wasm module once and passes it to every worker
+// so that workers only instantiate it.
+type Bootstrap struct {
+	// ModuleURL is the location of the wasm binary of this program.
+	// In node it is a file path.
+	ModuleURL string
+	// WasmExecURL is the location of wasm_exec.js.
+	// In node it is a path that is passed to require.
+	WasmExecURL string
+	// Module is the compiled WebAssembly.Module of this program,
+	// for example the module returned by WebAssembly.instantiateStreaming.
+	// When not set, ModuleURL is compiled on first use. In browsers,
+	// the server must serve it as application/wasm.
+	Module js.Value
+}
+
+// DefaultBootstrap is used by SpawnWorker.
+var DefaultBootstrap = Bootstrap{
+	ModuleURL:   "main.wasm",
+	WasmExecURL: "wasm_exec.js",
+}
+
+// bootstrapJS receives the module in the first message and runs it
+// with the args and the environment of the message.
+// Without a module in the message, it compiles the module URL itself.
+const bootstrapJS = `"use strict";
+(() => {
+	const moduleURL = %[1]s;
+	const wasmExecURL = %[2]s;
+	const isNode = typeof process !== "undefined" && process.release && process.release.name === "node";
+
+	if (isNode) {
+		require(wasmExecURL);
+	} else {
+		importScripts(wasmExecURL);
+	}
+
+	const compile = () => {
+		if (isNode) {
+			return WebAssembly.compile(require("fs").readFileSync(moduleURL));
+		}
+		if (typeof WebAssembly.compileStreaming === "function") {
+			return WebAssembly.compileStreaming(fetch(moduleURL));
+		}
+		return fetch(moduleURL).then((res) => res.arrayBuffer()).then((buf) => WebAssembly.compile(buf));
+	};
+
+	self.onmessage = (event) => {
+		// The Go program sets its own handler.
+		self.onmessage = null;
+
+		const data = event.data || {};
+		Promise.resolve(data.wasm_module || compile())
+			.then((module) => {
+				const go = new Go();
+				go.argv = data.argv || [moduleURL];
+				Object.assign(go.env, data.env);
+				return WebAssembly.instantiate(module, go.importObject).then((instance) => go.run(instance));
+			})
+			.catch((err) => console.error("wrpc: worker bootstrap failed:", err));
+	};
+})();
+`
+
+// Source returns the bootstrap script.
+func (b Bootstrap) Source() []byte {
+	return []byte(fmt.Sprintf(bootstrapJS, jsString(b.resolve(b.ModuleURL)), jsString(b.resolve(b.WasmExecURL))))
+}
+
+// CreateWorker creates a worker that runs this program with factory.
+func (b Bootstrap) CreateWorker(factory WorkerFactory, opts SpawnOptions) (*Worker, error) {
+	module, err := b.module()
+	if err != nil {
+		return nil, errorx.Decorate(err, "error compiling %s", b.ModuleURL)
+	}
+	init := map[string]interface{}{
+		"wasm_module": module,
+	}
+	opts.addArgsTo(init)
+	return createWorker(factory, b.Source(), init, opts)
+}
+
+// resolve makes url absolute since worker scripts created
+// from object URLs cannot resolve relative URLs.
+func (b Bootstrap) resolve(url string) string {
+	if jsutil.IsNode || js.Global().Get("location").Type() != js.TypeObject {
+		return url
+	}
+	return js.Global().Get("URL").New(url, js.Global().Get("location").Get("href")).Call("toString").String()
+}
+
+var (
+	modulesMu sync.Mutex
+	// modules are the modules compiled by Bootstrap by URL.
+	modules = map[string]js.Value{}
+)
+
+// module returns the compiled module, compiling ModuleURL if needed.
+func (b Bootstrap) module() (js.Value, error) {
+	if b.Module.Truthy() {
+		return b.Module, nil
+	}
+
+	modulesMu.Lock()
+	defer modulesMu.Unlock()
+
+	url := b.resolve(b.ModuleURL)
+	if module, ok := modules[url]; ok {
+		return module, nil
+	}
+
+	var promise js.Value
+	if jsutil.IsNode {
+		promise = js.Global().Get("require").Invoke("fs").Get("promises").Call("readFile", url).
+			Call("then", js.Global().Get("WebAssembly").Get("compile"))
+	} else {
+		promise = js.Global().Get("WebAssembly").Call("compileStreaming", js.Global().Call("fetch", url))
+	}
+
+	module, err := jsutil.Await(promise)
+	if err != nil {
+		return js.Undefined(), err
+	}
+	modules[url] = module
+	return module, nil
+}
+
+// jsString quotes s as a javascript string literal.
+func jsString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
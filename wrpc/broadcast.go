@@ -0,0 +1,151 @@
+// +build js,wasm
+
+package wrpc
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+
+	"github.com/joomcode/errorx"
+)
+
+// BroadcastOptions configures Broadcast.
+type BroadcastOptions struct {
+	// Input is written to the call on every worker.
+	Input []byte
+	// OnJoin, when set, also runs the call on the workers
+	// that are spawned later until ctx is done and passes their results to it.
+	OnJoin func(BroadcastResult)
+}
+
+// BroadcastResult is the result of a broadcast call on a worker.
+type BroadcastResult struct {
+	Worker *Worker
+	// Output is what the call wrote to its output.
+	Output []byte
+	// Err is set when the call could not be run or its output could not be read.
+	Err error
+}
+
+// Broadcast runs f once on each live worker, bypassing the scheduler,
+// and returns the results in the order of Workers.
+// It waits until every call has closed its output or ctx is done.
+func Broadcast(ctx context.Context, f RemoteCall, opts BroadcastOptions) []BroadcastResult {
+	// Register before releasing the workers so that every worker runs f once.
+	workersMu.Lock()
+	targets := append([]*Worker(nil), workers...)
+	if opts.OnJoin != nil {
+		broadcasts.add(ctx, f, opts)
+	}
+	workersMu.Unlock()
+
+	results := make([]BroadcastResult, len(targets))
+
+	var wg sync.WaitGroup
+	for i, w := range targets {
+		i, w := i, w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = runOn(ctx, w, f, opts.Input)
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
+
+// runOn runs f on worker w.
+func runOn(ctx context.Context, w *Worker, f RemoteCall, input []byte) BroadcastResult {
+	result := BroadcastResult{Worker: w}
+	if err := checkRegistered(f); err != nil {
+		result.Err = err
+		return result
+	}
+
+	h := newHandle()
+	var in io.Reader
+	if input != nil {
+		in = bytes.NewReader(input)
+	}
+	out := &outputBuffer{}
+	call := newCall(h, in, out, f, false)
+	call.pinned = true
+
+	if err := w.MessagePort().postMessage(Message{Kind: MessageCall, Call: call.message()}); err != nil {
+		h.fail(errorx.Decorate(err, "error posting call"))
+		call.Output.Close()
+	}
+	h.seal()
+
+	select {
+	case <-h.Done():
+		result.Output = out.Bytes()
+		result.Err = h.Err()
+	case <-ctx.Done():
+		result.Err = ctx.Err()
+	}
+
+	return result
+}
+
+// outputBuffer is a WriteCloser that buffers the output of a call.
+type outputBuffer struct {
+	bytes.Buffer
+}
+
+// Close does nothing.
+func (b *outputBuffer) Close() error {
+	return nil
+}
+
+// broadcasts are the broadcasts that run on workers spawned later.
+var broadcasts = &broadcastSet{}
+
+type broadcastSet struct {
+	mu   sync.Mutex
+	list []*pendingBroadcast
+}
+
+type pendingBroadcast struct {
+	ctx  context.Context
+	f    RemoteCall
+	opts BroadcastOptions
+}
+
+// add registers a broadcast until ctx is done.
+func (s *broadcastSet) add(ctx context.Context, f RemoteCall, opts BroadcastOptions) {
+	b := &pendingBroadcast{ctx: ctx, f: f, opts: opts}
+
+	s.mu.Lock()
+	s.list = append(s.list, b)
+	s.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for i, other := range s.list {
+			if other == b {
+				s.list = append(s.list[:i], s.list[i+1:]...)
+				break
+			}
+		}
+	}()
+}
+
+// join runs the registered broadcasts on a new worker.
+func (s *broadcastSet) join(w *Worker) {
+	s.mu.Lock()
+	list := append([]*pendingBroadcast(nil), s.list...)
+	s.mu.Unlock()
+
+	for _, b := range list {
+		b := b
+		go func() {
+			b.opts.OnJoin(runOn(b.ctx, w, b.f, b.opts.Input))
+		}()
+	}
+}
@@ -1,12 +1,5 @@
-// +build js,wasm
-
 package wrpc
 
-import (
-	"syscall/js"
-	"unsafe"
-)
-
 // Call is a remote call that can be scheduled to a worker.
 type Call struct {
 	// RemoteCall will be run in a remote webworker.
@@ -15,44 +8,74 @@ type Call struct {
 	Input *MessagePort
 	// ResultPort is the port where the result gets written into.
 	Output *MessagePort
+	// Shared values passed to the call by reference.
+	Shared map[string]interface{}
+
+	// pinned calls run on the worker they are posted to.
+	pinned bool
+	// compress enables the compression of the ports.
+	compress bool
 }
 
 // Execute the call locally.
 func (c Call) exec(cb func()) {
 	defer cb()
+	if c.Input == nil {
+		// Do not pass a typed nil.
+		c.RemoteCall(nil, c.Output)
+		return
+	}
 	c.RemoteCall(c.Input, c.Output)
 }
 
-// getJSCall returns js messages along with transferables that can be sent over a MessagePort.
-func (c Call) getJS() (messages map[string]interface{}, transferables []interface{}) {
-	rc := *(*uintptr)(unsafe.Pointer(&c.RemoteCall))
-	messages = map[string]interface{}{
-		"rc":     int(rc),
-		"output": c.Output,
-	}
-	transferables = []interface{}{
-		c.Output,
+// message returns the call as a message. The transports of its ports are transferred.
+func (c Call) message() *CallMessage {
+	m := &CallMessage{
+		RemoteCall: c.RemoteCall,
+		Output:     c.Output.t,
+		Shared:     c.Shared,
+		Pinned:     c.pinned,
+		Compress:   c.compress,
 	}
 	if c.Input != nil {
-		messages["input"] = c.Input
-		transferables = append(transferables, c.Input)
+		m.Input = c.Input.t
 	}
-	return
+	return m
 }
 
-// newCallFromJS constructs a call from javascript arguments.
-func newCallFromJS(rc, input, output js.Value) Call {
-	rcPtr := uintptr(rc.Int())
-	remoteCall := *(*RemoteCall)(unsafe.Pointer(&rcPtr))
-
+// newCallFromMessage constructs a call from a received message.
+func newCallFromMessage(m *CallMessage) Call {
 	var inputPort *MessagePort
-	if input.Truthy() {
-		inputPort = NewMessagePort(input)
+	if m.Input != nil {
+		inputPort = NewPort(m.Input)
 	}
 
-	return Call{
-		RemoteCall: remoteCall,
+	call := Call{
+		RemoteCall: m.RemoteCall,
 		Input:      inputPort,
-		Output:     NewMessagePort(output),
+		Output:     NewPort(m.Output),
+		Shared:     m.Shared,
+		pinned:     m.Pinned,
+		compress:   m.Compress,
+	}
+
+	// Let the call look up its shared values through its ports.
+	call.Output.shared = call.Shared
+	call.Output.SetCompression(call.compress)
+	if call.Input != nil {
+		call.Input.shared = call.Shared
+		call.Input.SetCompression(call.compress)
+	}
+
+	return call
+}
+
+// sharedValue returns the shared value of the call that has out as output.
+func sharedValue(out interface{}, name string) (interface{}, bool) {
+	port, ok := out.(*MessagePort)
+	if !ok {
+		return nil, false
 	}
+	v, ok := port.shared[name]
+	return v, ok
 }
@@ -0,0 +1,84 @@
+package wrpc
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"sync"
+
+	"github.com/joomcode/errorx"
+)
+
+const (
+	// compressMin is the smallest write that is compressed.
+	// Smaller writes are not worth the cost and are sent as they are.
+	compressMin = 1024
+	// compressChunk is the largest write that is compressed in one message.
+	// It bounds the memory a receiver spends to inflate a message.
+	compressChunk = 256 << 10
+)
+
+var deflaters = sync.Pool{
+	New: func() interface{} {
+		// BestSpeed since the streams are local and the cost is on the writer.
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+// deflate compresses p. It reports false when p does not get smaller.
+func deflate(p []byte) ([]byte, bool) {
+	var buf bytes.Buffer
+	buf.Grow(len(p) / 2)
+
+	w := deflaters.Get().(*flate.Writer)
+	defer deflaters.Put(w)
+	w.Reset(&buf)
+
+	if _, err := w.Write(p); err != nil {
+		return nil, false
+	}
+	if err := w.Close(); err != nil {
+		return nil, false
+	}
+	if buf.Len() >= len(p) {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+// inflate decompresses a message compressed by deflate.
+func inflate(p []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(p))
+	defer r.Close()
+
+	var buf bytes.Buffer
+	// Read one byte past the limit to detect a message that inflates too much.
+	if _, err := io.Copy(&buf, io.LimitReader(r, compressChunk+1)); err != nil {
+		return nil, errorx.Decorate(err, "invalid compressed data")
+	}
+	if buf.Len() > compressChunk {
+		return nil, errorx.IllegalFormat.New("compressed data inflates over %d bytes", compressChunk)
+	}
+	return buf.Bytes(), nil
+}
+
+// SetCompression makes the port compress its writes when the remote end supports it.
+// Writes smaller than a kilobyte and data that does not compress are sent as they are.
+// Readers get the data back as it was written. Writes are sent as they are
+// until the remote end is ready and tells that it accepts compressed writes.
+func (port *MessagePort) SetCompression(enabled bool) {
+	port.mu.Lock()
+	defer port.mu.Unlock()
+	port.compress = enabled
+}
+
+// compressing reports whether a write of p should be compressed.
+func (port *MessagePort) compressing(p []byte) bool {
+	if len(p) < compressMin {
+		return false
+	}
+	port.mu.Lock()
+	defer port.mu.Unlock()
+	return port.compress && port.remoteInflates
+}
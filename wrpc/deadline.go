@@ -0,0 +1,124 @@
+package wrpc
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrDeadlineExceeded is returned by the reads and writes of a MessagePort after its deadline.
+// Like os.ErrDeadlineExceeded it is a net.Error whose Timeout method returns true.
+var ErrDeadlineExceeded error = deadlineExceededError{}
+
+type deadlineExceededError struct{}
+
+func (deadlineExceededError) Error() string   { return "i/o timeout" }
+func (deadlineExceededError) Timeout() bool   { return true }
+func (deadlineExceededError) Temporary() bool { return true }
+
+// deadline is closed when a deadline passes, the same way as in net.Pipe.
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{cancel: make(chan struct{})}
+}
+
+// set sets the deadline. The zero time clears it.
+// Pending operations wait for the new deadline.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		// Wait for the timer callback to finish and close cancel.
+		<-d.cancel
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() {
+			close(cancel)
+		})
+		return
+	}
+
+	// The deadline is in the past.
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel that is closed when the deadline passes.
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// readResult is the result of a read from the pipe of a port.
+type readResult struct {
+	data []byte
+	err  error
+}
+
+// SetDeadline sets the read and write deadlines of the port.
+func (port *MessagePort) SetDeadline(t time.Time) error {
+	if err := port.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return port.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for future and pending reads.
+// Reads after the deadline fail with ErrDeadlineExceeded. The data of a read
+// that timed out is returned by the next read. The zero time clears the deadline.
+func (port *MessagePort) SetReadDeadline(t time.Time) error {
+	if port.closed() {
+		return io.ErrClosedPipe
+	}
+	port.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for future and pending writes.
+// Writes after the deadline fail with ErrDeadlineExceeded. A write that timed out
+// while waiting for the remote end returns the bytes it posted, which the remote end
+// still reads. The zero time clears the deadline.
+func (port *MessagePort) SetWriteDeadline(t time.Time) error {
+	if port.closed() {
+		return io.ErrClosedPipe
+	}
+	port.writeDeadline.set(t)
+	return nil
+}
+
+func (port *MessagePort) closed() bool {
+	port.mu.Lock()
+	defer port.mu.Unlock()
+	return port.state == portClosed
+}
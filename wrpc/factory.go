@@ -0,0 +1,101 @@
+// +build js,wasm
+
+package wrpc
+
+import (
+	"syscall/js"
+
+	"github.com/joomcode/errorx"
+	"github.com/mgnsk/jsutil"
+	"github.com/mgnsk/jsutil/logger"
+)
+
+// WorkerFactory starts js workers.
+type WorkerFactory interface {
+	// NewWorker starts a worker that runs the javascript source.
+	// The returned value implements the web Worker interface:
+	// postMessage, terminate and the onmessage event handler property.
+	NewWorker(source []byte) (js.Value, error)
+}
+
+// DefaultWorkerFactory is used by CreateWorkerFromSource.
+// It creates node worker_threads when running in node and web workers otherwise.
+var DefaultWorkerFactory WorkerFactory
+
+func init() {
+	if jsutil.IsNode {
+		DefaultWorkerFactory = NodeWorkerFactory{}
+	} else {
+		DefaultWorkerFactory = BrowserWorkerFactory{}
+	}
+}
+
+// BrowserWorkerFactory creates web workers.
+type BrowserWorkerFactory struct{}
+
+// NewWorker creates a web worker from an object URL of source.
+func (BrowserWorkerFactory) NewWorker(source []byte) (js.Value, error) {
+	if js.Global().Get("Worker").Type() != js.TypeFunction {
+		return js.Undefined(), errorx.UnsupportedOperation.New("Worker is not available")
+	}
+	url := jsutil.CreateURLObject(string(source), "application/javascript")
+	return js.Global().Get("Worker").New(url), nil
+}
+
+// nodeWorkerPrelude sets up a worker_threads global scope
+// like a web worker's so that the same source runs in both.
+const nodeWorkerPrelude = `"use strict";
+const { parentPort } = require("worker_threads");
+globalThis.require = require;
+globalThis.fs = require("fs");
+globalThis.path = require("path");
+if (!globalThis.TextEncoder) globalThis.TextEncoder = require("util").TextEncoder;
+if (!globalThis.TextDecoder) globalThis.TextDecoder = require("util").TextDecoder;
+if (!globalThis.performance) globalThis.performance = require("perf_hooks").performance;
+if (!globalThis.crypto) globalThis.crypto = require("crypto").webcrypto;
+globalThis.self = globalThis;
+globalThis.postMessage = (message, transfer) => parentPort.postMessage(message, transfer);
+parentPort.on("message", (data) => {
+	if (typeof globalThis.onmessage === "function") {
+		globalThis.onmessage({ data });
+	}
+});
+`
+
+// NodeWorkerFactory creates node worker_threads.
+// The source runs in a scope that provides self, postMessage and onmessage
+// like a web worker and the globals wasm_exec.js expects in node.
+type NodeWorkerFactory struct{}
+
+// NewWorker evaluates source in a new worker thread.
+func (NodeWorkerFactory) NewWorker(source []byte) (js.Value, error) {
+	if !jsutil.IsNode {
+		return js.Undefined(), errorx.UnsupportedOperation.New("worker_threads is not available")
+	}
+
+	worker := js.Global().Get("require").Invoke("worker_threads").Get("Worker").New(
+		nodeWorkerPrelude+string(source),
+		map[string]interface{}{"eval": true},
+	)
+
+	// Dispatch the node events to the web Worker event handler properties.
+	// The handlers live as long as the worker.
+	onmessage := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if handler := worker.Get("onmessage"); handler.Type() == js.TypeFunction {
+			handler.Invoke(map[string]interface{}{"data": args[0]})
+		}
+		return nil
+	})
+	onerror := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if handler := worker.Get("onerror"); handler.Type() == js.TypeFunction {
+			handler.Invoke(args[0])
+		} else {
+			logger.Error("wrpc: worker error", logger.F("err", args[0]))
+		}
+		return nil
+	})
+	worker.Call("on", "message", onmessage)
+	worker.Call("on", "error", onerror)
+
+	return worker, nil
+}
@@ -0,0 +1,254 @@
+package wrpc
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// FaultOptions configures the faults that a FaultInjector injects into posted messages.
+// Rates are probabilities from 0 to 1.
+type FaultOptions struct {
+	// Seed seeds the random source. Runs that post the same messages
+	// in the same order get the same faults.
+	Seed int64
+	// Kinds are the kinds of messages that faults are injected into.
+	// When empty, faults are injected into every message.
+	Kinds []MessageKind
+	// DropRate is the rate of messages that are lost.
+	DropRate float64
+	// DuplicateRate is the rate of messages that are delivered twice.
+	DuplicateRate float64
+	// ReorderRate is the rate of messages that are delivered after the next message.
+	ReorderRate float64
+	// DelayRate is the rate of messages that are delayed by up to MaxDelay.
+	// The poster is blocked for the delay so that the order is kept.
+	DelayRate float64
+	MaxDelay  time.Duration
+}
+
+// FaultInjector injects faults into the transports it wraps.
+// It is a test harness for calls that must survive lost, late and repeated messages
+// or transports that are closed under them.
+type FaultInjector struct {
+	opts  FaultOptions
+	kinds map[MessageKind]bool
+
+	mu     sync.Mutex
+	rand   *rand.Rand
+	killed bool
+	// wrapped are the transports that Kill closes.
+	wrapped map[*faultTransport]struct{}
+	// stalled is true when acks are held back.
+	stalled bool
+	acks    []*faultTransport
+}
+
+// NewFaultInjector creates a fault injector.
+func NewFaultInjector(opts FaultOptions) *FaultInjector {
+	f := &FaultInjector{
+		opts:    opts,
+		rand:    rand.New(rand.NewSource(opts.Seed)),
+		wrapped: map[*faultTransport]struct{}{},
+	}
+	if len(opts.Kinds) > 0 {
+		f.kinds = make(map[MessageKind]bool, len(opts.Kinds))
+		for _, kind := range opts.Kinds {
+			f.kinds[kind] = true
+		}
+	}
+	return f
+}
+
+// Wrap returns t with faults injected into the messages posted to it.
+func (f *FaultInjector) Wrap(t Transport) Transport {
+	ft := &faultTransport{Transport: t, f: f}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.killed {
+		t.Close()
+	} else {
+		f.wrapped[ft] = struct{}{}
+	}
+	return ft
+}
+
+// Channel returns the ends of an in-memory channel with faults injected in both directions.
+func (f *FaultInjector) Channel() (Transport, Transport) {
+	a, b := NewMemoryChannel()
+	return f.Wrap(a), f.Wrap(b)
+}
+
+// InjectFaults makes Pipe create its channels through f until restore is called.
+// The pipes of the calls started in between are affected.
+// On js the ends that are transferred to workers are unwrapped,
+// so only the messages posted on this thread get faults.
+func InjectFaults(f *FaultInjector) (restore func()) {
+	channelMu.Lock()
+	defer channelMu.Unlock()
+
+	prev := newChannel
+	newChannel = func() (Transport, Transport) {
+		a, b := prev()
+		return f.Wrap(a), f.Wrap(b)
+	}
+
+	return func() {
+		channelMu.Lock()
+		defer channelMu.Unlock()
+		newChannel = prev
+	}
+}
+
+// Kill closes the transports wrapped on this thread. Nothing is delivered to them anymore
+// and posting to them behaves like posting to a closed transport.
+// On js, the transports transferred to another thread are unwrapped first,
+// so Kill does not close them there. Transports wrapped after Kill are closed right away.
+func (f *FaultInjector) Kill() {
+	f.mu.Lock()
+	f.killed = true
+	f.stalled = false
+	f.acks = nil
+	wrapped := f.wrapped
+	f.wrapped = map[*faultTransport]struct{}{}
+	f.mu.Unlock()
+
+	for t := range wrapped {
+		t.Transport.Close()
+	}
+}
+
+// StallAcks holds back the acks posted to the wrapped transports until ReleaseAcks,
+// so that writers block as if the reader was slow.
+func (f *FaultInjector) StallAcks() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stalled = true
+}
+
+// ReleaseAcks posts the acks held back by StallAcks.
+func (f *FaultInjector) ReleaseAcks() {
+	f.mu.Lock()
+	acks := f.acks
+	f.stalled = false
+	f.acks = nil
+	f.mu.Unlock()
+
+	for _, t := range acks {
+		t.Transport.Post(Message{Kind: MessageAck})
+	}
+}
+
+// fault is what happens to a posted message.
+type fault struct {
+	drop, duplicate, reorder bool
+	delay                    time.Duration
+}
+
+// next returns the fault for msg. One value is drawn per kind of fault
+// so that the faults do not depend on the rates of the others.
+func (f *FaultInjector) next(msg Message) fault {
+	var ft fault
+	if f.kinds != nil && !f.kinds[msg.Kind] {
+		return ft
+	}
+	ft.drop = f.rand.Float64() < f.opts.DropRate
+	ft.duplicate = f.rand.Float64() < f.opts.DuplicateRate
+	ft.reorder = f.rand.Float64() < f.opts.ReorderRate
+	delayed := f.rand.Float64() < f.opts.DelayRate
+	if f.opts.MaxDelay > 0 {
+		d := time.Duration(f.rand.Int63n(int64(f.opts.MaxDelay)))
+		if delayed {
+			ft.delay = d
+		}
+	}
+	return ft
+}
+
+// faultTransport injects the faults of f into the messages posted to Transport.
+type faultTransport struct {
+	Transport
+	f *FaultInjector
+
+	mu sync.Mutex
+	// held is a reordered message that is posted after the next one.
+	held *Message
+}
+
+func (t *faultTransport) Post(msg Message) error {
+	f := t.f
+
+	f.mu.Lock()
+	if f.killed {
+		f.mu.Unlock()
+		return t.Transport.Post(msg)
+	}
+	if f.stalled && msg.Kind == MessageAck {
+		f.acks = append(f.acks, t)
+		f.mu.Unlock()
+		return nil
+	}
+	ft := f.next(msg)
+	f.mu.Unlock()
+
+	if ft.drop {
+		return nil
+	}
+	if ft.delay > 0 {
+		time.Sleep(ft.delay)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if ft.reorder && t.held == nil {
+		t.held = &msg
+		return nil
+	}
+	if err := t.Transport.Post(msg); err != nil {
+		return err
+	}
+	if ft.duplicate {
+		if err := t.Transport.Post(msg); err != nil {
+			return err
+		}
+	}
+	if held := t.held; held != nil {
+		t.held = nil
+		return t.Transport.Post(*held)
+	}
+	return nil
+}
+
+func (t *faultTransport) Listen(handler func(Message)) {
+	t.Transport.Listen(func(msg Message) {
+		t.f.mu.Lock()
+		killed := t.f.killed
+		t.f.mu.Unlock()
+		if !killed {
+			handler(msg)
+		}
+	})
+}
+
+func (t *faultTransport) carriesDeflate() bool {
+	return carriesDeflate(t.Transport)
+}
+
+// Close posts a reordered message that is still held back and closes the transport.
+func (t *faultTransport) Close() {
+	t.mu.Lock()
+	held := t.held
+	t.held = nil
+	t.mu.Unlock()
+
+	t.f.mu.Lock()
+	killed := t.f.killed
+	delete(t.f.wrapped, t)
+	t.f.mu.Unlock()
+
+	if held != nil && !killed {
+		t.Transport.Post(*held)
+	}
+	t.Transport.Close()
+}
@@ -0,0 +1,229 @@
+package wrpc
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/joomcode/errorx"
+)
+
+// MapOptions configures GoMap.
+type MapOptions struct {
+	// Split splits the input into chunks.
+	// Defaults to ScanRecords('\n').
+	Split bufio.SplitFunc
+	// MaxChunkSize is the largest chunk Split may return.
+	// Defaults to bufio.MaxScanTokenSize.
+	MaxChunkSize int
+	// Workers is the number of chunks processed in parallel.
+	// Defaults to the number of ports the global scheduler runs on.
+	Workers int
+	// Ordered merges the outputs in the order of the input chunks.
+	// Otherwise outputs are merged as soon as they are done.
+	Ordered bool
+}
+
+func (o MapOptions) split() bufio.SplitFunc {
+	if o.Split == nil {
+		return ScanRecords('\n')
+	}
+	return o.Split
+}
+
+func (o MapOptions) maxChunkSize() int {
+	if o.MaxChunkSize <= 0 {
+		return bufio.MaxScanTokenSize
+	}
+	return o.MaxChunkSize
+}
+
+func (o MapOptions) workers() int {
+	if o.Workers > 0 {
+		return o.Workers
+	}
+	if n := GlobalScheduler.runnerCount(); n > 0 {
+		return n
+	}
+	return 1
+}
+
+// ScanRecords is a split function that returns records terminated by delim.
+// Unlike bufio.ScanLines, the delimiter is kept so that outputs can be merged as they are.
+func ScanRecords(delim byte) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		if atEOF && len(data) == 0 {
+			return 0, nil, nil
+		}
+		if i := bytes.IndexByte(data, delim); i >= 0 {
+			return i + 1, data[:i+1], nil
+		}
+		if atEOF {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	}
+}
+
+// ScanChunks is a split function that returns chunks of size bytes.
+// The last chunk may be shorter.
+func ScanChunks(size int) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		if atEOF && len(data) == 0 {
+			return 0, nil, nil
+		}
+		if len(data) >= size {
+			return size, data[:size], nil
+		}
+		if atEOF {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	}
+}
+
+// GoMap splits in into chunks, runs f on each chunk on parallel workers
+// and merges the outputs into out.
+// The returned Handle is done when out is closed.
+func GoMap(in io.Reader, out io.WriteCloser, f RemoteCall, opts MapOptions) *Handle {
+	h := newHandle()
+	defer h.seal()
+
+	if out == nil {
+		h.fail(errorx.IllegalArgument.New("must have output"))
+		return h
+	}
+
+	h.run(func() error {
+		defer out.Close()
+		if in == nil {
+			return nil
+		}
+		return mapChunks(in, out, f, opts)
+	})
+
+	return h
+}
+
+// mapResult is the output of a single chunk.
+type mapResult struct {
+	data []byte
+	err  error
+}
+
+// chunkBuffer collects the output of a chunk.
+type chunkBuffer struct {
+	bytes.Buffer
+}
+
+// Close is a no-op.
+func (b *chunkBuffer) Close() error {
+	return nil
+}
+
+func mapChunks(in io.Reader, out io.Writer, f RemoteCall, opts MapOptions) error {
+	scanner := bufio.NewScanner(in)
+	scanner.Split(opts.split())
+	scanner.Buffer(nil, opts.maxChunkSize())
+
+	n := opts.workers()
+	sem := make(chan struct{}, n)
+	results := make(chan chan mapResult, n)
+
+	// failed is closed on the first error to stop dispatching chunks.
+	failed := make(chan struct{})
+	var failOnce sync.Once
+	fail := func() {
+		failOnce.Do(func() { close(failed) })
+	}
+
+	// Merge the results in the order they are received from results.
+	var mergeErr error
+	mergeDone := make(chan struct{})
+	go func() {
+		defer close(mergeDone)
+		for res := range results {
+			r := <-res
+			if mergeErr != nil {
+				// Keep draining to not block the chunks.
+				continue
+			}
+			if r.err != nil {
+				mergeErr = r.err
+			} else if _, err := out.Write(r.data); err != nil {
+				mergeErr = errorx.Decorate(err, "error merging output")
+				fail()
+			}
+		}
+	}()
+
+	// Scan in a goroutine so that a failure does not wait for more input.
+	chunks := make(chan []byte)
+	scanErr := make(chan error, 1)
+	go func() {
+		defer close(chunks)
+		for scanner.Scan() {
+			select {
+			case chunks <- append([]byte(nil), scanner.Bytes()...):
+			case <-failed:
+				scanErr <- nil
+				return
+			}
+		}
+		scanErr <- scanner.Err()
+	}()
+
+	var wg sync.WaitGroup
+dispatch:
+	for chunk := range chunks {
+		select {
+		case sem <- struct{}{}:
+		case <-failed:
+			break dispatch
+		}
+
+		res := make(chan mapResult, 1)
+		if opts.Ordered {
+			// Queue the result in input order before it is done.
+			results <- res
+		}
+
+		wg.Add(1)
+		go func(chunk []byte) {
+			defer wg.Done()
+			r := runChunk(chunk, f)
+			if r.err != nil {
+				fail()
+			}
+			res <- r
+			<-sem
+			if !opts.Ordered {
+				// Queue the result when it is done.
+				results <- res
+			}
+		}(chunk)
+	}
+
+	wg.Wait()
+	close(results)
+	<-mergeDone
+
+	if mergeErr != nil {
+		// The rest of the input is not read.
+		return mergeErr
+	}
+	if err := <-scanErr; err != nil {
+		return errorx.Decorate(err, "error splitting input")
+	}
+	return nil
+}
+
+// runChunk runs f with chunk as input and collects its output.
+func runChunk(chunk []byte, f RemoteCall) mapResult {
+	buf := &chunkBuffer{}
+	if err := Go(bytes.NewReader(chunk), buf, f).Wait(); err != nil {
+		return mapResult{err: err}
+	}
+	return mapResult{data: buf.Bytes()}
+}
@@ -0,0 +1,337 @@
+package wrpc
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/joomcode/errorx"
+)
+
+type nodeKind int
+
+const (
+	sourceNode nodeKind = iota
+	sinkNode
+	callNode
+	teeNode
+	mergeNode
+)
+
+// Node is a stage in a Graph.
+type Node struct {
+	graph *Graph
+	name  string
+	kind  nodeKind
+	call  RemoteCall
+	in    []*edge
+	out   []*edge
+}
+
+// Name returns the name of the node.
+func (n *Node) Name() string {
+	return n.name
+}
+
+// local reports whether the node runs on this thread instead of a worker.
+func (n *Node) local() bool {
+	return n.kind != callNode
+}
+
+// edge is a stream between two nodes.
+type edge struct {
+	from, to *Node
+	// reader and writer are the ends of the stream
+	// while the graph is running.
+	reader io.Reader
+	writer io.WriteCloser
+}
+
+// Graph is a pipeline of RemoteCalls connected by wrpc pipes.
+// Unlike GoChain, a stream can be split with a tee node
+// and joined with a merge node.
+type Graph struct {
+	nodes  []*Node
+	edges  []*edge
+	source *Node
+	sink   *Node
+}
+
+// NewGraph constructor.
+func NewGraph() *Graph {
+	g := &Graph{}
+	g.source = g.add("source", sourceNode, nil)
+	g.sink = g.add("sink", sinkNode, nil)
+	return g
+}
+
+func (g *Graph) add(name string, kind nodeKind, f RemoteCall) *Node {
+	n := &Node{
+		graph: g,
+		name:  name,
+		kind:  kind,
+		call:  f,
+	}
+	g.nodes = append(g.nodes, n)
+	return n
+}
+
+// Source returns the node that emits the input of the graph.
+func (g *Graph) Source() *Node {
+	return g.source
+}
+
+// Sink returns the node that writes into the output of the graph.
+func (g *Graph) Sink() *Node {
+	return g.sink
+}
+
+// Call adds a node that runs f on a worker.
+// It must have exactly one input and one output.
+func (g *Graph) Call(name string, f RemoteCall) *Node {
+	return g.add(name, callNode, f)
+}
+
+// Tee adds a node that copies its single input into every output.
+func (g *Graph) Tee(name string) *Node {
+	return g.add(name, teeNode, nil)
+}
+
+// Merge adds a node that concatenates its inputs into a single output
+// in the order they were connected. All inputs are read concurrently
+// so that a merge of tee'd streams cannot deadlock.
+func (g *Graph) Merge(name string) *Node {
+	return g.add(name, mergeNode, nil)
+}
+
+// Connect adds a stream from the output of from to the input of to.
+func (g *Graph) Connect(from, to *Node) {
+	e := &edge{from: from, to: to}
+	g.edges = append(g.edges, e)
+	from.out = append(from.out, e)
+	to.in = append(to.in, e)
+}
+
+// Validate checks that every node is connected and that there are no cycles.
+// All problems in the graph are reported in a single error.
+func (g *Graph) Validate() error {
+	var errs []error
+
+	names := map[string]bool{}
+	for _, n := range g.nodes {
+		if names[n.name] {
+			errs = append(errs, errorx.IllegalArgument.New("duplicate node name %q", n.name))
+		}
+		names[n.name] = true
+
+		if n.kind == callNode && n.call == nil {
+			errs = append(errs, errorx.IllegalArgument.New("node %q: must have a RemoteCall", n.name))
+		}
+
+		minIn, maxIn, minOut, maxOut := n.degrees()
+		if len(n.in) < minIn {
+			errs = append(errs, errorx.IllegalArgument.New("node %q: unconnected input", n.name))
+		} else if maxIn >= 0 && len(n.in) > maxIn {
+			errs = append(errs, errorx.IllegalArgument.New("node %q: has %d inputs, expected at most %d", n.name, len(n.in), maxIn))
+		}
+		if len(n.out) < minOut {
+			errs = append(errs, errorx.IllegalArgument.New("node %q: unconnected output", n.name))
+		} else if maxOut >= 0 && len(n.out) > maxOut {
+			errs = append(errs, errorx.IllegalArgument.New("node %q: has %d outputs, expected at most %d", n.name, len(n.out), maxOut))
+		}
+	}
+
+	for _, e := range g.edges {
+		if e.from.graph != g || e.to.graph != g {
+			errs = append(errs, errorx.IllegalArgument.New("edge %q -> %q: node belongs to another graph", e.from.name, e.to.name))
+		}
+	}
+
+	if n := g.findCycle(); n != nil {
+		errs = append(errs, errorx.IllegalArgument.New("node %q: is part of a cycle", n.name))
+	}
+
+	return errorx.DecorateMany("invalid graph", errs...)
+}
+
+// degrees returns the allowed number of inputs and outputs of a node.
+// A negative maximum means unlimited.
+func (n *Node) degrees() (minIn, maxIn, minOut, maxOut int) {
+	switch n.kind {
+	case sourceNode:
+		return 0, 0, 1, 1
+	case sinkNode:
+		return 1, 1, 0, 0
+	case teeNode:
+		return 1, 1, 1, -1
+	case mergeNode:
+		return 1, -1, 1, 1
+	default:
+		return 1, 1, 1, 1
+	}
+}
+
+// findCycle returns a node on a cycle or nil.
+func (g *Graph) findCycle() *Node {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := map[*Node]int{}
+
+	var visit func(n *Node) *Node
+	visit = func(n *Node) *Node {
+		switch state[n] {
+		case visiting:
+			return n
+		case visited:
+			return nil
+		}
+		state[n] = visiting
+		for _, e := range n.out {
+			if c := visit(e.to); c != nil {
+				return c
+			}
+		}
+		state[n] = visited
+		return nil
+	}
+
+	for _, n := range g.nodes {
+		if c := visit(n); c != nil {
+			return c
+		}
+	}
+	return nil
+}
+
+// Run validates the graph and runs it with in as the source and out as the sink.
+// The returned Handle is done when every node is done and reports
+// the errors of all nodes.
+func (g *Graph) Run(in io.Reader, out io.WriteCloser) *Handle {
+	h := newHandle()
+	defer h.seal()
+
+	if out == nil {
+		h.fail(errorx.IllegalArgument.New("must have output"))
+		return h
+	}
+
+	if err := g.Validate(); err != nil {
+		h.fail(err)
+		return h
+	}
+
+	for _, e := range g.edges {
+		if e.from.local() || e.to.local() {
+			// Calls pipe local streams through their own ports.
+			e.reader, e.writer = io.Pipe()
+		} else {
+			// Connect workers directly.
+			e.reader, e.writer = Pipe()
+		}
+	}
+
+	for _, n := range g.nodes {
+		n := n
+		h.run(func() error {
+			if err := n.run(in, out); err != nil {
+				// Unblock the neighbours of the failed node.
+				n.abort(err)
+				return errorx.Decorate(err, "node %q", n.name)
+			}
+			return nil
+		})
+	}
+
+	return h
+}
+
+func (n *Node) run(in io.Reader, out io.WriteCloser) error {
+	switch n.kind {
+	case sourceNode:
+		w := n.out[0].writer
+		defer w.Close()
+		if in == nil {
+			return nil
+		}
+		_, err := io.Copy(w, in)
+		return err
+
+	case sinkNode:
+		defer out.Close()
+		_, err := io.Copy(out, n.in[0].reader)
+		return err
+
+	case teeNode:
+		writers := make([]io.Writer, len(n.out))
+		for i, e := range n.out {
+			defer e.writer.Close()
+			writers[i] = e.writer
+		}
+		_, err := io.Copy(io.MultiWriter(writers...), n.in[0].reader)
+		return err
+
+	case mergeNode:
+		return n.merge()
+
+	default:
+		return Go(n.in[0].reader, n.out[0].writer, n.call).Wait()
+	}
+}
+
+// abort closes the streams of the node with err.
+func (n *Node) abort(err error) {
+	for _, e := range n.in {
+		closeWithError(e.reader, err)
+	}
+	for _, e := range n.out {
+		closeWithError(e.writer, err)
+	}
+}
+
+func closeWithError(v interface{}, err error) {
+	switch c := v.(type) {
+	case interface{ CloseWithError(error) error }:
+		c.CloseWithError(err)
+	case io.Closer:
+		c.Close()
+	}
+}
+
+// merge streams the first input and buffers the others until it is their turn.
+func (n *Node) merge() error {
+	w := n.out[0].writer
+	defer w.Close()
+
+	type buffered struct {
+		buf  bytes.Buffer
+		err  error
+		done chan struct{}
+	}
+
+	rest := make([]*buffered, len(n.in)-1)
+	for i, e := range n.in[1:] {
+		b := &buffered{done: make(chan struct{})}
+		rest[i] = b
+		r := e.reader
+		go func() {
+			defer close(b.done)
+			_, b.err = io.Copy(&b.buf, r)
+		}()
+	}
+
+	_, err := io.Copy(w, n.in[0].reader)
+	for _, b := range rest {
+		<-b.done
+		if err != nil {
+			continue
+		}
+		if b.err != nil {
+			err = b.err
+			continue
+		}
+		_, err = b.buf.WriteTo(w)
+	}
+	return err
+}
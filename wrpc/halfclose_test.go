@@ -0,0 +1,86 @@
+package wrpc
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// The specs in this file only use Pipe, so they run over the memory transport
+// natively and over a MessageChannel on js.
+
+// readAll reads r to the end in a new goroutine.
+func readAll(r io.Reader) <-chan []byte {
+	c := make(chan []byte, 1)
+	go func() {
+		b, _ := ioutil.ReadAll(r)
+		c <- b
+	}()
+	return c
+}
+
+// halfCloseRequest writes a request from client and closes it for writing.
+// server reads the request until EOF and writes back the response.
+func halfCloseRequest(client, server *MessagePort) {
+	go func() {
+		defer GinkgoRecover()
+		defer server.Close()
+		b, err := ioutil.ReadAll(server)
+		Expect(err).To(BeNil())
+		_, err = server.Write(bytes.ToUpper(b))
+		Expect(err).To(BeNil())
+	}()
+
+	_, err := client.Write([]byte("hello"))
+	Expect(err).To(BeNil())
+	Expect(client.CloseWrite()).To(Succeed())
+
+	_, err = client.Write([]byte("more"))
+	Expect(err).To(Equal(io.ErrClosedPipe))
+
+	Eventually(readAll(client)).Should(Receive(Equal([]byte("HELLO"))))
+}
+
+var _ = Describe("Half-close", func() {
+	It("reads the response after closing the request", func() {
+		client, server := Pipe()
+		halfCloseRequest(client, server)
+		Expect(client.CloseWrite()).To(Equal(io.EOF))
+	})
+
+	It("drops the writes to a port that stopped reading", func() {
+		a, b := Pipe()
+		Expect(a.CloseRead()).To(Succeed())
+		Eventually(b.RemoteReady()).Should(Receive())
+
+		_, err := a.Read(make([]byte, 1))
+		Expect(err).To(Equal(io.ErrClosedPipe))
+
+		Eventually(func() error {
+			_, err := b.Write([]byte("dropped"))
+			return err
+		}).Should(Equal(io.EOF))
+
+		// The other direction still works.
+		c := readAll(b)
+		_, err = a.Write([]byte("reply"))
+		Expect(err).To(BeNil())
+		Expect(a.Close()).To(Succeed())
+		Eventually(c).Should(Receive(Equal([]byte("reply"))))
+	})
+
+	It("closes each direction once", func() {
+		a, b := Pipe()
+		Expect(a.CloseWrite()).To(Succeed())
+		Expect(a.CloseWrite()).To(Equal(io.ErrClosedPipe))
+		Expect(a.CloseRead()).To(Succeed())
+		Expect(a.CloseRead()).To(Equal(io.ErrClosedPipe))
+		Expect(a.Close()).To(Succeed())
+		Expect(a.CloseWrite()).To(Equal(io.ErrClosedPipe))
+
+		Eventually(readAll(b)).Should(Receive(BeEmpty()))
+	})
+})
@@ -0,0 +1,72 @@
+package wrpc
+
+import (
+	"sync"
+
+	"github.com/joomcode/errorx"
+)
+
+// Handle tracks the local goroutines of a remote call
+// and collects the errors they report.
+type Handle struct {
+	wg   sync.WaitGroup
+	mu   sync.Mutex
+	errs []error
+	done chan struct{}
+}
+
+func newHandle() *Handle {
+	return &Handle{
+		done: make(chan struct{}),
+	}
+}
+
+// run runs f in a new goroutine tracked by the handle.
+func (h *Handle) run(f func() error) {
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		if err := f(); err != nil {
+			h.fail(err)
+		}
+	}()
+}
+
+// join makes h wait for other and collect its errors.
+func (h *Handle) join(other *Handle) {
+	h.run(other.Wait)
+}
+
+// fail records an error.
+func (h *Handle) fail(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.errs = append(h.errs, err)
+}
+
+// seal closes Done when all goroutines started so far have finished.
+// No goroutines may be started after seal.
+func (h *Handle) seal() {
+	go func() {
+		h.wg.Wait()
+		close(h.done)
+	}()
+}
+
+// Done returns a channel that is closed when the call has finished.
+func (h *Handle) Done() <-chan struct{} {
+	return h.done
+}
+
+// Err returns the errors reported so far combined into one, or nil.
+func (h *Handle) Err() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return errorx.DecorateMany("remote call failed", h.errs...)
+}
+
+// Wait blocks until the call has finished and returns its error.
+func (h *Handle) Wait() error {
+	<-h.done
+	return h.Err()
+}
@@ -1,5 +1,3 @@
-// +build js,wasm
-
 package wrpc
 
 // GlobalScheduler is main scheduler to schedule to workers.
@@ -7,3 +5,20 @@ var GlobalScheduler = NewScheduler()
 
 // CallCount specifies how many calls are currently processing.
 var CallCount uint64 = 0
+
+// maxCalls is the number of calls a worker runs concurrently.
+// Calls over the limit are rescheduled to other workers.
+var maxCalls uint64 = 1
+
+// acceptCalls is true when ports run the calls they receive.
+// Only workers accept calls.
+var acceptCalls bool
+
+// localID is the worker ID of this thread. The main thread is 0.
+var localID int
+
+// WorkerID returns the ID of the worker this thread runs in.
+// It is 0 on the main thread.
+func WorkerID() int {
+	return localID
+}
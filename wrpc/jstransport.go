@@ -0,0 +1,456 @@
+// +build js,wasm
+
+package wrpc
+
+import (
+	"runtime"
+	"sync"
+	"syscall/js"
+
+	"github.com/joomcode/errorx"
+	"github.com/mgnsk/jsutil"
+	"github.com/mgnsk/jsutil/array"
+	"github.com/mgnsk/jsutil/logger"
+)
+
+func init() {
+	acceptCalls = jsutil.IsWorker
+	newChannel = newJSChannel
+}
+
+// jsTransport is a Transport over a js MessagePort.
+type jsTransport struct {
+	// JS MessagePort object.
+	value js.Value
+
+	mu                                 sync.Mutex
+	onerror, onmessage, onmessageerror js.Func
+	listening                          bool
+}
+
+// newJSChannel creates a js MessageChannel.
+func newJSChannel() (Transport, Transport) {
+	ch := js.Global().Get("MessageChannel").New()
+	return newJSTransport(ch.Get("port1")), newJSTransport(ch.Get("port2"))
+}
+
+func newJSTransport(value js.Value) *jsTransport {
+	t := &jsTransport{value: value}
+	// Clean up when the transport is not used anymore.
+	runtime.SetFinalizer(t, func(t *jsTransport) {
+		t.release()
+	})
+	return t
+}
+
+// NewMessagePort creates a port over a js MessagePort.
+func NewMessagePort(value js.Value) *MessagePort {
+	return NewPort(newJSTransport(value))
+}
+
+// JSValue returns the underlying js value.
+func (port *MessagePort) JSValue() js.Value {
+	if port == nil {
+		return js.Null()
+	}
+	if t, ok := asJSTransport(port.t); ok {
+		return t.value
+	}
+	return js.Undefined()
+}
+
+// asJSTransport returns the js transport of t.
+// The transports wrapped by a FaultInjector are unwrapped, so that they can be transferred.
+func asJSTransport(t Transport) (*jsTransport, bool) {
+	if ft, ok := t.(*faultTransport); ok {
+		t = ft.Transport
+	}
+	jt, ok := t.(*jsTransport)
+	return jt, ok
+}
+
+// PostMessage sends a raw js message to remote end.
+func (port *MessagePort) PostMessage(args ...interface{}) {
+	port.JSValue().Call("postMessage", args...)
+}
+
+// Post encodes msg and posts it to the js port.
+func (t *jsTransport) Post(msg Message) error {
+	message, transferables, err := encodeMessage(msg)
+	if err != nil {
+		return err
+	}
+	t.value.Call("postMessage", message, transferables)
+	return nil
+}
+
+// Listen sets the event handlers of the js port.
+func (t *jsTransport) Listen(handler func(Message)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.releaseLocked()
+
+	t.onerror = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		logger.Error("wrpc: MessagePort: onerror", logger.F("event", args[0]))
+		return nil
+	})
+
+	t.onmessage = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		// A hostile message must not crash the thread.
+		defer func() {
+			if r := recover(); r != nil {
+				logger.Error("wrpc: MessagePort: panic handling message", logger.F("panic", r))
+			}
+		}()
+		if msg, ok := decodeMessage(args[0].Get("data")); ok {
+			handler(msg)
+		}
+		return nil
+	})
+
+	t.onmessageerror = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		logger.Error("wrpc: MessagePort: onmessageerror", logger.F("event", args[0]))
+		return nil
+	})
+
+	t.value.Set("onerror", t.onerror)
+	t.value.Set("onmessage", t.onmessage)
+	t.value.Set("onmessageerror", t.onmessageerror)
+	t.listening = true
+}
+
+func (t *jsTransport) carriesDeflate() bool {
+	return true
+}
+
+// Close closes the js port.
+func (t *jsTransport) Close() {
+	t.value.Call("close")
+}
+
+func (t *jsTransport) release() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.releaseLocked()
+}
+
+func (t *jsTransport) releaseLocked() {
+	if !t.listening {
+		return
+	}
+	t.onerror.Release()
+	t.onmessage.Release()
+	t.onmessageerror.Release()
+	t.listening = false
+}
+
+// encodeMessage returns the js message along with transferables.
+func encodeMessage(msg Message) (message map[string]interface{}, transferables []interface{}, err error) {
+	switch msg.Kind {
+	case MessageReady:
+		return map[string]interface{}{"ready": true, "deflate": msg.Deflate}, nil, nil
+
+	case MessageAck:
+		return map[string]interface{}{"ack": true}, nil, nil
+
+	case MessageDone:
+		return map[string]interface{}{"done": true}, nil, nil
+
+	case MessageEOF:
+		if msg.Shutdown != ShutdownBoth {
+			return map[string]interface{}{"EOF": true, "shutdown": int(msg.Shutdown)}, nil, nil
+		}
+		return map[string]interface{}{"EOF": true}, nil, nil
+
+	case MessageData, MessageTopic:
+		arr, err := array.CreateBufferFromSlice(msg.Data)
+		if err != nil {
+			return nil, nil, err
+		}
+		transferables = []interface{}{arr.JSValue()}
+		if msg.Kind == MessageTopic {
+			return map[string]interface{}{"topic": msg.Topic, "msg": arr.JSValue()}, transferables, nil
+		}
+		message = map[string]interface{}{"arr": arr.JSValue()}
+		if msg.Deflate {
+			message["deflate"] = true
+		}
+		return message, transferables, nil
+
+	case MessageCall:
+		return encodeCall(msg.Call)
+
+	case MessageOutput:
+		arr, err := array.CreateBufferFromSlice(msg.Data)
+		if err != nil {
+			return nil, nil, err
+		}
+		output := map[string]interface{}{"fd": msg.FD, "data": arr.JSValue()}
+		return map[string]interface{}{"output": output}, []interface{}{arr.JSValue()}, nil
+
+	case MessageLog:
+		if msg.Entry == nil {
+			return nil, nil, errorx.IllegalArgument.New("log message without entry")
+		}
+		entry := map[string]interface{}{"level": int(msg.Entry.Level), "msg": msg.Entry.Msg}
+		return map[string]interface{}{"log": entry}, nil, nil
+
+	case MessageHello:
+		return map[string]interface{}{"hello": msg.ID}, nil, nil
+
+	case MessagePing:
+		return map[string]interface{}{"ping": true}, nil, nil
+
+	case MessageService, MessageOpen:
+		if msg.Service == nil {
+			return nil, nil, errorx.IllegalArgument.New("service message without service")
+		}
+		if msg.Kind == MessageService {
+			return map[string]interface{}{
+				"service": msg.Service.Name,
+				"host":    msg.ID,
+				"up":      msg.Service.Up,
+			}, nil, nil
+		}
+		conn, ok := asJSTransport(msg.Service.Conn)
+		if !ok {
+			return nil, nil, errorx.IllegalArgument.New("cannot transfer stream %T", msg.Service.Conn)
+		}
+		return map[string]interface{}{
+			"open": msg.Service.Name,
+			"conn": conn.value,
+		}, []interface{}{conn.value}, nil
+	}
+
+	return nil, nil, errorx.IllegalArgument.New("unknown message kind %d", msg.Kind)
+}
+
+func encodeCall(c *CallMessage) (message map[string]interface{}, transferables []interface{}, err error) {
+	output, ok := asJSTransport(c.Output)
+	if !ok {
+		return nil, nil, errorx.IllegalArgument.New("cannot transfer output %T", c.Output)
+	}
+
+	message = map[string]interface{}{
+		"rc":     int(callID(c.RemoteCall)),
+		"output": output.value,
+	}
+	transferables = []interface{}{output.value}
+
+	if c.Pinned {
+		message["pinned"] = true
+	}
+
+	if c.Compress {
+		message["compress"] = true
+	}
+
+	if c.Input != nil {
+		input, ok := asJSTransport(c.Input)
+		if !ok {
+			return nil, nil, errorx.IllegalArgument.New("cannot transfer input %T", c.Input)
+		}
+		message["input"] = input.value
+		transferables = append(transferables, input.value)
+	}
+
+	if len(c.Shared) > 0 {
+		shared := make(map[string]interface{}, len(c.Shared))
+		for name, v := range c.Shared {
+			switch v := v.(type) {
+			case js.Value:
+				shared[name] = v
+			case Shareable:
+				shared[name] = v.JSValue()
+			default:
+				return nil, nil, errorx.IllegalArgument.New("cannot share %s of type %T", name, v)
+			}
+		}
+		message["shared"] = shared
+	}
+
+	return message, transferables, nil
+}
+
+// decodeMessage decodes a js message. It reports false for messages that are not part of the protocol.
+// Messages of a known kind with an invalid shape are returned with Err set.
+func decodeMessage(data js.Value) (Message, bool) {
+	if data.Type() != js.TypeObject {
+		return Message{}, false
+	}
+
+	if data.Get("ready") != js.Undefined() {
+		return Message{Kind: MessageReady, Deflate: data.Get("deflate").Truthy()}, true
+	}
+
+	if data.Get("ack") != js.Undefined() {
+		return Message{Kind: MessageAck}, true
+	}
+
+	if data.Get("done") != js.Undefined() {
+		return Message{Kind: MessageDone}, true
+	}
+
+	if data.Get("ping") != js.Undefined() {
+		return Message{Kind: MessagePing}, true
+	}
+
+	if data.Get("EOF") != js.Undefined() {
+		msg := Message{Kind: MessageEOF}
+		// An unknown direction closes the port.
+		if how := data.Get("shutdown"); isInt(how) {
+			switch Shutdown(how.Int()) {
+			case ShutdownWrite, ShutdownRead:
+				msg.Shutdown = Shutdown(how.Int())
+			}
+		}
+		return msg, true
+	}
+
+	// Published topic message.
+	if topic := data.Get("topic"); topic.Type() == js.TypeString {
+		msg, err := copyBuffer(data.Get("msg"))
+		if err != nil {
+			err = errorx.Decorate(err, "invalid message of topic %s", topic.String())
+		}
+		return Message{Kind: MessageTopic, Topic: topic.String(), Data: msg, Err: err}, true
+	}
+
+	// Remote call.
+	if rc := data.Get("rc"); rc != js.Undefined() {
+		call, err := decodeCall(data)
+		return Message{Kind: MessageCall, Call: call, Err: err}, true
+	}
+
+	// Forwarded worker output.
+	if output := data.Get("output"); output.Type() == js.TypeObject && !isPort(output) {
+		fd := output.Get("fd")
+		if fd.Type() != js.TypeNumber {
+			return Message{Kind: MessageOutput, Err: errorx.IllegalFormat.New("invalid output fd")}, true
+		}
+		buf, err := copyBuffer(output.Get("data"))
+		return Message{Kind: MessageOutput, FD: fd.Int(), Data: buf, Err: err}, true
+	}
+
+	if entry := data.Get("log"); entry.Type() == js.TypeObject {
+		level, msg := entry.Get("level"), entry.Get("msg")
+		if level.Type() != js.TypeNumber || msg.Type() != js.TypeString {
+			return Message{Kind: MessageLog, Err: errorx.IllegalFormat.New("invalid log entry")}, true
+		}
+		return Message{Kind: MessageLog, Entry: &logger.Entry{
+			Level: logger.Level(level.Int()),
+			Msg:   msg.String(),
+		}}, true
+	}
+
+	// Mesh and service messages.
+	if id := data.Get("hello"); id != js.Undefined() {
+		if !isInt(id) {
+			return Message{Kind: MessageHello, Err: errorx.IllegalFormat.New("invalid worker ID")}, true
+		}
+		return Message{Kind: MessageHello, ID: id.Int()}, true
+	}
+
+	if name := data.Get("service"); name.Type() == js.TypeString {
+		host := data.Get("host")
+		if !isInt(host) {
+			return Message{Kind: MessageService, Err: errorx.IllegalFormat.New("invalid host of service %s", name.String())}, true
+		}
+		return Message{Kind: MessageService, ID: host.Int(), Service: &ServiceMessage{
+			Name: name.String(),
+			Up:   data.Get("up").Truthy(),
+		}}, true
+	}
+
+	if name := data.Get("open"); name.Type() == js.TypeString {
+		conn := data.Get("conn")
+		if !isPort(conn) {
+			return Message{Kind: MessageOpen, Err: errorx.IllegalFormat.New("invalid stream to service %s", name.String())}, true
+		}
+		return Message{Kind: MessageOpen, Service: &ServiceMessage{
+			Name: name.String(),
+			Conn: newJSTransport(conn),
+		}}, true
+	}
+
+	// ArrayBuffer data message.
+	if arr := data.Get("arr"); arr != js.Undefined() {
+		buf, err := copyBuffer(arr)
+		if err != nil {
+			err = errorx.Decorate(err, "copyBytes: error")
+		}
+		return Message{Kind: MessageData, Data: buf, Deflate: data.Get("deflate").Truthy(), Err: err}, true
+	}
+
+	return Message{}, false
+}
+
+// decodeCall decodes a call message. On error, the returned call
+// holds the ports that could be decoded so that they can be closed.
+func decodeCall(data js.Value) (*CallMessage, error) {
+	c := &CallMessage{
+		Pinned:   data.Get("pinned").Truthy(),
+		Compress: data.Get("compress").Truthy(),
+	}
+
+	if output := data.Get("output"); isPort(output) {
+		c.Output = newJSTransport(output)
+	} else {
+		return c, errorx.IllegalFormat.New("invalid call output")
+	}
+
+	switch input := data.Get("input"); {
+	case isPort(input):
+		c.Input = newJSTransport(input)
+	case input.Type() != js.TypeUndefined && input.Type() != js.TypeNull:
+		return c, errorx.IllegalFormat.New("invalid call input")
+	}
+
+	rc := data.Get("rc")
+	if !isInt(rc) || rc.Float() < 0 {
+		return c, errorx.IllegalFormat.New("invalid remote call")
+	}
+	f, ok := lookupCall(uintptr(rc.Float()))
+	if !ok {
+		return c, errorx.IllegalArgument.New("remote call %d is not registered", rc.Int())
+	}
+	c.RemoteCall = f
+
+	switch shared := data.Get("shared"); shared.Type() {
+	case js.TypeUndefined:
+	case js.TypeObject:
+		c.Shared = map[string]interface{}{}
+		keys := js.Global().Get("Object").Call("keys", shared)
+		for i := 0; i < keys.Length(); i++ {
+			name := keys.Index(i).String()
+			c.Shared[name] = shared.Get(name)
+		}
+	default:
+		return c, errorx.IllegalFormat.New("invalid shared values")
+	}
+
+	return c, nil
+}
+
+// isPort reports whether v is a js MessagePort.
+func isPort(v js.Value) bool {
+	return v.Type() == js.TypeObject && v.InstanceOf(js.Global().Get("MessagePort"))
+}
+
+// isInt reports whether v is an integer number.
+func isInt(v js.Value) bool {
+	return v.Type() == js.TypeNumber && v.Float() == float64(int64(v.Float()))
+}
+
+// copyBuffer copies the bytes of an ArrayBuffer.
+func copyBuffer(value js.Value) ([]byte, error) {
+	if !value.InstanceOf(js.Global().Get("ArrayBuffer")) {
+		return nil, errorx.IllegalFormat.New("not an ArrayBuffer")
+	}
+	buf := array.Buffer(value)
+	if buf.ByteLength() == 0 {
+		return nil, nil
+	}
+	return buf.CopyBytes()
+}
@@ -0,0 +1,68 @@
+package wrpc
+
+import "sync"
+
+// links are the ports to the directly connected threads.
+var links = &linkSet{
+	ports: map[*MessagePort]struct{}{},
+	peers: map[int]*MessagePort{},
+}
+
+// linkSet is a set of ports to the directly connected threads.
+// Since workers form a full mesh and the main thread is linked
+// to every worker, a message posted to every link reaches every thread once.
+type linkSet struct {
+	mu    sync.Mutex
+	ports map[*MessagePort]struct{}
+	// peers are the ports by the worker ID of the other end.
+	peers map[int]*MessagePort
+}
+
+// add adds port to the set until the port is closed
+// and tells the other end the ID of this thread.
+func (s *linkSet) add(port *MessagePort) {
+	s.mu.Lock()
+	s.ports[port] = struct{}{}
+	s.mu.Unlock()
+
+	port.post(Message{Kind: MessageHello, ID: localID})
+
+	go func() {
+		<-port.ctx.Done()
+		s.mu.Lock()
+		delete(s.ports, port)
+		for id, p := range s.peers {
+			if p == port {
+				delete(s.peers, id)
+				services.dropHost(id)
+			}
+		}
+		s.mu.Unlock()
+	}()
+}
+
+// identify records the worker ID of the other end of port.
+func (s *linkSet) identify(port *MessagePort, id int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.peers[id] = port
+}
+
+// peer returns the port to the worker with id.
+func (s *linkSet) peer(id int) (*MessagePort, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	port, ok := s.peers[id]
+	return port, ok
+}
+
+// list returns the ports in the set.
+func (s *linkSet) list() []*MessagePort {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ports := make([]*MessagePort, 0, len(s.ports))
+	for port := range s.ports {
+		ports = append(ports, port)
+	}
+	return ports
+}
@@ -0,0 +1,115 @@
+package wrpc
+
+import (
+	"sync"
+
+	"github.com/joomcode/errorx"
+)
+
+// memoryTransport is one end of an in-memory channel.
+// It simulates a js MessagePort with goroutines: messages are queued until
+// the end listens, delivered in order and payloads are copied as if transferred.
+type memoryTransport struct {
+	peer *memoryTransport
+
+	mu      sync.Mutex
+	handler func(Message)
+	queue   []Message
+	closed  bool
+	wake    chan struct{}
+}
+
+// NewMemoryChannel returns the two connected ends of an in-memory channel.
+func NewMemoryChannel() (Transport, Transport) {
+	a := newMemoryTransport()
+	b := newMemoryTransport()
+	a.peer, b.peer = b, a
+	return a, b
+}
+
+func newMemoryTransport() *memoryTransport {
+	t := &memoryTransport{
+		wake: make(chan struct{}, 1),
+	}
+	go t.dispatch()
+	return t
+}
+
+// Post queues msg on the other end. Like a js MessagePort,
+// messages to a closed end are dropped silently.
+func (t *memoryTransport) Post(msg Message) error {
+	t.mu.Lock()
+	closed := t.closed
+	t.mu.Unlock()
+	if closed {
+		return errorx.IllegalState.New("transport closed")
+	}
+
+	if msg.Data != nil {
+		msg.Data = append([]byte{}, msg.Data...)
+	}
+	t.peer.push(msg)
+	return nil
+}
+
+// Listen starts delivering messages to handler.
+func (t *memoryTransport) Listen(handler func(Message)) {
+	t.mu.Lock()
+	t.handler = handler
+	t.mu.Unlock()
+	t.signal()
+}
+
+func (t *memoryTransport) carriesDeflate() bool {
+	return true
+}
+
+// Close drops the pending messages of this end and stops its delivery.
+// Messages already posted to the other end are still delivered there.
+func (t *memoryTransport) Close() {
+	t.mu.Lock()
+	t.closed = true
+	t.queue = nil
+	t.mu.Unlock()
+	t.signal()
+}
+
+func (t *memoryTransport) push(msg Message) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+	t.queue = append(t.queue, msg)
+	t.signal()
+}
+
+func (t *memoryTransport) signal() {
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+}
+
+// dispatch delivers the queued messages one at a time like an event loop.
+func (t *memoryTransport) dispatch() {
+	for range t.wake {
+		for {
+			t.mu.Lock()
+			if t.closed {
+				t.mu.Unlock()
+				return
+			}
+			if t.handler == nil || len(t.queue) == 0 {
+				t.mu.Unlock()
+				break
+			}
+			msg := t.queue[0]
+			t.queue = t.queue[1:]
+			handler := t.handler
+			t.mu.Unlock()
+
+			handler(msg)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+// +build !js !wasm
+
+package wrpc
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const memoryWorkerCount = 2
+
+func TestMemory(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "wrpc memory")
+}
+
+var _ = BeforeSuite(func() {
+	// Serve calls in this process as if there were workers on the other end of the channels.
+	acceptCalls = true
+	// The workers share CallCount, so let calls that wait for each other run at once.
+	maxCalls = 16
+	for i := 0; i < memoryWorkerCount; i++ {
+		main, worker := NewMemoryChannel()
+		NewPort(worker)
+		go GlobalScheduler.RunScheduler(context.Background(), NewPort(main))
+	}
+})
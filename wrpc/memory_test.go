@@ -0,0 +1,1589 @@
+// +build !js !wasm
+
+package wrpc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joomcode/errorx"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// buffer is an in-memory WriteCloser.
+type buffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *buffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+func init() {
+	Register(upper, reverse, done, flood)
+}
+
+func upper(in io.Reader, out io.WriteCloser) {
+	defer out.Close()
+	b, _ := ioutil.ReadAll(in)
+	out.Write(bytes.ToUpper(b))
+}
+
+func reverse(in io.Reader, out io.WriteCloser) {
+	defer out.Close()
+	b, _ := ioutil.ReadAll(in)
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	out.Write(b)
+}
+
+func done(in io.Reader, out io.WriteCloser) {
+	defer out.Close()
+	if wg, ok := SharedValue(out, "wg"); ok {
+		wg.(*sync.WaitGroup).Done()
+	}
+}
+
+// flooded receives the error that stopped flood.
+var flooded = make(chan error, 1)
+
+func flood(in io.Reader, out io.WriteCloser) {
+	defer out.Close()
+	for {
+		if _, err := out.Write([]byte("x")); err != nil {
+			flooded <- err
+			return
+		}
+	}
+}
+
+func wait(h *Handle) error {
+	select {
+	case <-h.Done():
+		return h.Err()
+	case <-time.After(10 * time.Second):
+		return fmt.Errorf("timeout")
+	}
+}
+
+// collect listens on t and sends the received messages to a channel.
+func collect(t Transport) <-chan Message {
+	c := make(chan Message, 16)
+	t.Listen(func(msg Message) {
+		c <- msg
+	})
+	return c
+}
+
+var _ = Describe("MemoryChannel", func() {
+	It("queues messages until the end listens", func() {
+		a, b := NewMemoryChannel()
+		for i := 0; i < 3; i++ {
+			Expect(a.Post(Message{Kind: MessageData, Data: []byte{byte(i)}})).To(Succeed())
+		}
+
+		c := collect(b)
+		for i := 0; i < 3; i++ {
+			var msg Message
+			Eventually(c).Should(Receive(&msg))
+			Expect(msg.Data).To(Equal([]byte{byte(i)}))
+		}
+	})
+
+	It("copies the posted data", func() {
+		a, b := NewMemoryChannel()
+		c := collect(b)
+
+		data := []byte("abc")
+		Expect(a.Post(Message{Kind: MessageData, Data: data})).To(Succeed())
+		data[0] = 'x'
+
+		var msg Message
+		Eventually(c).Should(Receive(&msg))
+		Expect(msg.Data).To(Equal([]byte("abc")))
+	})
+
+	It("drops messages to a closed end", func() {
+		a, b := NewMemoryChannel()
+		c := collect(b)
+		b.Close()
+
+		Expect(a.Post(Message{Kind: MessageAck})).To(Succeed())
+		Consistently(c, 50*time.Millisecond).ShouldNot(Receive())
+		Expect(b.Post(Message{Kind: MessageAck})).NotTo(Succeed())
+	})
+})
+
+var _ = Describe("Pipe", func() {
+	It("writes to the other end", func() {
+		r, w := Pipe()
+		go func() {
+			defer w.Close()
+			w.Write([]byte("hello "))
+			w.Write([]byte("world"))
+		}()
+
+		b, err := ioutil.ReadAll(r)
+		Expect(err).To(BeNil())
+		Expect(string(b)).To(Equal("hello world"))
+	})
+
+	It("returns EOF to a writer after the reader closed", func() {
+		r, w := Pipe()
+		Expect(r.Close()).To(Succeed())
+		Expect(r.Close()).To(Equal(io.ErrClosedPipe))
+
+		Eventually(func() error {
+			_, err := w.Write([]byte("late"))
+			return err
+		}).Should(Equal(io.EOF))
+	})
+})
+
+// recordingTransport records the data messages it posts.
+type recordingTransport struct {
+	Transport
+
+	mu       sync.Mutex
+	sent     int
+	deflated int
+	// eof is set when the port was closed and afterEOF counts the data posted after it.
+	eof      bool
+	afterEOF int
+}
+
+func (t *recordingTransport) Post(msg Message) error {
+	t.mu.Lock()
+	switch {
+	case msg.Kind == MessageEOF && msg.Shutdown == ShutdownBoth:
+		t.eof = true
+	case msg.Kind == MessageData:
+		t.sent += len(msg.Data)
+		if msg.Deflate {
+			t.deflated++
+		}
+		if t.eof {
+			t.afterEOF++
+		}
+	}
+	t.mu.Unlock()
+	return t.Transport.Post(msg)
+}
+
+func (t *recordingTransport) stats() (sent, deflated int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.sent, t.deflated
+}
+
+// chanConn is one end of an in-memory FrameConn.
+type chanConn struct {
+	in, out chan []byte
+	closed  chan struct{}
+	once    *sync.Once
+}
+
+// frameConns returns the two connected ends of an in-memory FrameConn.
+func frameConns() (FrameConn, FrameConn) {
+	a, b := make(chan []byte, 64), make(chan []byte, 64)
+	closed, once := make(chan struct{}), &sync.Once{}
+	return &chanConn{in: a, out: b, closed: closed, once: once},
+		&chanConn{in: b, out: a, closed: closed, once: once}
+}
+
+func (c *chanConn) ReadFrame() ([]byte, error) {
+	select {
+	case frame := <-c.in:
+		return frame, nil
+	case <-c.closed:
+		return nil, io.EOF
+	}
+}
+
+func (c *chanConn) WriteFrame(frame []byte) error {
+	select {
+	case c.out <- append([]byte{}, frame...):
+		return nil
+	case <-c.closed:
+		return io.ErrClosedPipe
+	}
+}
+
+func (c *chanConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+var _ = Describe("Session", func() {
+	It("fails the calls in flight when it is closed", func() {
+		release := make(chan struct{})
+		defer close(release)
+		block := func(in io.Reader, out io.WriteCloser) {
+			<-release
+			out.Close()
+		}
+
+		for i := 0; i < 20; i++ {
+			a, b := frameConns()
+			s1 := NewSession(a, nil)
+			NewSession(b, map[string]RemoteCall{"block": block})
+
+			// Make calls until the session has ended,
+			// so that some are being registered while it ends.
+			var (
+				mu      sync.Mutex
+				handles []*Handle
+				wg      sync.WaitGroup
+			)
+			for j := 0; j < 4; j++ {
+				wg.Add(1)
+				go func(j int) {
+					defer wg.Done()
+					for k := 0; k < 100; k++ {
+						var in io.Reader
+						if j%2 == 0 {
+							in = strings.NewReader("input")
+						}
+						h := s1.Go(in, &buffer{}, "block")
+						mu.Lock()
+						handles = append(handles, h)
+						mu.Unlock()
+						select {
+						case <-s1.Done():
+							return
+						default:
+						}
+					}
+				}(j)
+			}
+			time.Sleep(time.Millisecond)
+			Expect(s1.Close()).To(Succeed())
+			wg.Wait()
+
+			timeout := time.After(5 * time.Second)
+			for _, h := range handles {
+				select {
+				case <-h.Done():
+					Expect(h.Err()).NotTo(BeNil())
+				case <-timeout:
+					Fail("a call is stuck after the session was closed")
+				}
+			}
+		}
+	})
+
+	It("streams compressed data", func() {
+		a, b := frameConns()
+		s1, s2 := NewSession(a, nil), NewSession(b, nil)
+		defer s1.Close()
+
+		t := &recordingTransport{Transport: s1.stream(streamKey{id: 1, local: true})}
+		w := NewPort(t)
+		r := NewPort(s2.stream(streamKey{id: 1}))
+		w.SetCompression(true)
+		Eventually(w.RemoteReady(), 5*time.Second).Should(Receive())
+
+		data := bytes.Repeat([]byte("compressible "), 1<<12)
+		c := readAll(r)
+		_, err := w.Write(data)
+		Expect(err).To(BeNil())
+		Expect(w.Close()).To(Succeed())
+
+		Eventually(c, 5*time.Second).Should(Receive(Equal(data)))
+		_, deflated := t.stats()
+		Expect(deflated).To(BeNumerically(">", 0))
+	})
+
+	It("delivers the queued messages of a stream before the ones posted while it starts listening", func() {
+		a, b := frameConns()
+		s1, s2 := NewSession(a, nil), NewSession(b, nil)
+		defer s1.Close()
+
+		w := s1.stream(streamKey{id: 1, local: true})
+		r := s2.stream(streamKey{id: 1})
+		Expect(w.Post(Message{Kind: MessageData, Data: []byte("queued")})).To(Succeed())
+		Eventually(func() int {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			return len(r.queue)
+		}, 5*time.Second).Should(Equal(1))
+
+		var (
+			mu       sync.Mutex
+			received []string
+		)
+		flushing := make(chan struct{})
+		go r.Listen(func(msg Message) {
+			if string(msg.Data) == "queued" {
+				// Post the next message while the queue is being delivered.
+				close(flushing)
+				time.Sleep(50 * time.Millisecond)
+			}
+			mu.Lock()
+			received = append(received, string(msg.Data))
+			mu.Unlock()
+		})
+		<-flushing
+		Expect(w.Post(Message{Kind: MessageData, Data: []byte("live")})).To(Succeed())
+
+		Eventually(func() []string {
+			mu.Lock()
+			defer mu.Unlock()
+			return append([]string(nil), received...)
+		}, 5*time.Second).Should(Equal([]string{"queued", "live"}))
+	})
+
+	It("closes the request over a session", func() {
+		a, b := frameConns()
+		s1, s2 := NewSession(a, nil), NewSession(b, nil)
+		defer s1.Close()
+
+		client := NewPort(s1.stream(streamKey{id: 1, local: true}))
+		server := NewPort(s2.stream(streamKey{id: 1, local: false}))
+		halfCloseRequest(client, server)
+	})
+
+	It("closes the streams made after it ended", func() {
+		a, _ := frameConns()
+		s := NewSession(a, nil)
+		Expect(s.Close()).To(Succeed())
+		Eventually(s.Done(), 5*time.Second).Should(BeClosed())
+
+		// A call that registered before the session ended makes its streams after.
+		port := NewPort(s.stream(streamKey{id: 1, local: true}))
+		Eventually(readAll(port), 5*time.Second).Should(Receive(BeEmpty()))
+	})
+})
+
+var _ = Describe("Deadlines", func() {
+	It("times out a read and keeps its data for the next read", func() {
+		r, w := Pipe()
+		Expect(r.SetReadDeadline(time.Now().Add(50 * time.Millisecond))).To(Succeed())
+
+		buf := make([]byte, 3)
+		_, err := r.Read(buf)
+		Expect(err).To(Equal(ErrDeadlineExceeded))
+		Expect(err.(net.Error).Timeout()).To(BeTrue())
+
+		// The read stays expired until the deadline is moved.
+		_, err = r.Read(buf)
+		Expect(err).To(Equal(ErrDeadlineExceeded))
+
+		go w.Write([]byte("hello"))
+		Expect(r.SetReadDeadline(time.Time{})).To(Succeed())
+
+		n, err := r.Read(buf)
+		Expect(err).To(BeNil())
+		Expect(string(buf[:n])).To(Equal("hel"))
+		n, err = r.Read(buf)
+		Expect(err).To(BeNil())
+		Expect(string(buf[:n])).To(Equal("lo"))
+	})
+
+	It("unblocks a pending read", func() {
+		r, _ := Pipe()
+		errc := make(chan error, 1)
+		go func() {
+			_, err := r.Read(make([]byte, 1))
+			errc <- err
+		}()
+		Consistently(errc, 50*time.Millisecond).ShouldNot(Receive())
+
+		Expect(r.SetDeadline(time.Now())).To(Succeed())
+		Eventually(errc).Should(Receive(Equal(ErrDeadlineExceeded)))
+	})
+
+	It("extends the deadline of a pending read", func() {
+		r, w := Pipe()
+		Expect(r.SetReadDeadline(time.Now().Add(50 * time.Millisecond))).To(Succeed())
+		c := make(chan error, 1)
+		go func() {
+			_, err := r.Read(make([]byte, 1))
+			c <- err
+		}()
+		Expect(r.SetReadDeadline(time.Now().Add(time.Hour))).To(Succeed())
+		Consistently(c, 100*time.Millisecond).ShouldNot(Receive())
+
+		go w.Write([]byte("x"))
+		Eventually(c).Should(Receive(BeNil()))
+	})
+
+	It("times out a write without confusing the acks of later writes", func() {
+		f := NewFaultInjector(FaultOptions{})
+		a, b := f.Channel()
+		w, r := NewPort(a), NewPort(b)
+		Eventually(w.RemoteReady()).Should(Receive())
+		c := readAll(r)
+
+		f.StallAcks()
+		Expect(w.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))).To(Succeed())
+		n, err := w.Write([]byte("a"))
+		Expect(err).To(Equal(ErrDeadlineExceeded))
+		Expect(n).To(Equal(1))
+		// The ack of a is still due, b is not posted.
+		n, err = w.Write([]byte("b"))
+		Expect(err).To(Equal(ErrDeadlineExceeded))
+		Expect(n).To(BeZero())
+
+		// The ack of a is late. It must not complete the write of b.
+		f.ReleaseAcks()
+		f.StallAcks()
+		Expect(w.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))).To(Succeed())
+		n, err = w.Write([]byte("b"))
+		Expect(err).To(Equal(ErrDeadlineExceeded))
+		Expect(n).To(Equal(1))
+
+		f.ReleaseAcks()
+		Expect(w.SetWriteDeadline(time.Time{})).To(Succeed())
+		n, err = w.Write([]byte("c"))
+		Expect(err).To(BeNil())
+		Expect(n).To(Equal(1))
+
+		Expect(w.Close()).To(Succeed())
+		Eventually(c).Should(Receive(Equal([]byte("abc"))))
+	})
+
+	It("reports the bytes of a timed out write that the remote end reads", func() {
+		f := NewFaultInjector(FaultOptions{})
+		a, b := f.Channel()
+		w, r := NewPort(a), NewPort(b)
+		Eventually(w.RemoteReady()).Should(Receive())
+		c := readAll(r)
+
+		f.StallAcks()
+		Expect(w.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))).To(Succeed())
+		n, err := w.Write([]byte("hello"))
+		Expect(err).To(Equal(ErrDeadlineExceeded))
+		Expect(n).To(Equal(5))
+
+		f.ReleaseAcks()
+		Expect(w.SetWriteDeadline(time.Time{})).To(Succeed())
+		n, err = w.Write([]byte(" world"))
+		Expect(err).To(BeNil())
+		Expect(n).To(Equal(6))
+
+		Expect(w.Close()).To(Succeed())
+		Eventually(c).Should(Receive(Equal([]byte("hello world"))))
+	})
+
+	It("fails to set the deadline of a closed port", func() {
+		r, _ := Pipe()
+		Expect(r.Close()).To(Succeed())
+		Expect(r.SetDeadline(time.Now())).To(Equal(io.ErrClosedPipe))
+	})
+})
+
+var _ = Describe("Port state", func() {
+	It("allows only the defined transitions", func() {
+		port := newPort(nil)
+		Expect(port.setStateLocked(portHalfClosed)).To(BeTrue())
+		Expect(port.setStateLocked(portOpen)).To(BeFalse())
+		Expect(port.setStateLocked(portErrored)).To(BeTrue())
+		Expect(port.setStateLocked(portHalfClosed)).To(BeFalse())
+		Expect(port.setStateLocked(portEOF)).To(BeTrue())
+
+		for _, state := range []portState{portOpen, portHalfClosed, portClosed, portErrored} {
+			Expect(port.setStateLocked(state)).To(BeFalse(), state.String())
+		}
+		Expect(port.shutLocked(shutWrite)).To(BeFalse())
+	})
+
+	It("fails reads and writes of an errored port", func() {
+		a, b := NewMemoryChannel()
+		port := NewPort(b)
+		invalid := errorx.IllegalFormat.New("invalid data")
+		Expect(a.Post(Message{Kind: MessageData, Err: invalid})).To(Succeed())
+
+		_, err := port.Read(make([]byte, 1))
+		Expect(err).To(Equal(invalid))
+		_, err = port.Write([]byte("x"))
+		Expect(err).To(Equal(invalid))
+		Expect(port.CloseWrite()).To(Equal(invalid))
+
+		Expect(port.Close()).To(Succeed())
+		_, err = port.Write([]byte("x"))
+		Expect(err).To(Equal(io.ErrClosedPipe))
+	})
+
+	It("posts no data after closing with writes in flight", func() {
+		for i := 0; i < 20; i++ {
+			a, b := NewMemoryChannel()
+			t := &recordingTransport{Transport: a}
+			w, r := NewPort(t), NewPort(b)
+			go io.Copy(ioutil.Discard, r)
+
+			var wg sync.WaitGroup
+			for j := 0; j < 8; j++ {
+				wg.Add(1)
+				go func() {
+					defer GinkgoRecover()
+					defer wg.Done()
+					for {
+						if _, err := w.Write([]byte("data")); err != nil {
+							Expect(err).To(Equal(io.ErrClosedPipe))
+							return
+						}
+					}
+				}()
+			}
+
+			time.Sleep(time.Millisecond)
+			Expect(w.Close()).To(Succeed())
+			wg.Wait()
+
+			t.mu.Lock()
+			Expect(t.afterEOF).To(BeZero())
+			t.mu.Unlock()
+		}
+	})
+
+	It("closes both ends at once", func() {
+		for i := 0; i < 50; i++ {
+			a, b := Pipe()
+			errs := make(chan error, 2)
+			for _, port := range []*MessagePort{a, b} {
+				go func(port *MessagePort) {
+					errs <- port.Close()
+				}(port)
+			}
+			for j := 0; j < 2; j++ {
+				var err error
+				Eventually(errs).Should(Receive(&err))
+				Expect(err == nil || err == io.EOF).To(BeTrue(), fmt.Sprint(err))
+			}
+			_, err := a.Write([]byte("x"))
+			Expect(err).NotTo(BeNil())
+		}
+	})
+
+	It("reads and writes while the remote end half-closes", func() {
+		for i := 0; i < 20; i++ {
+			a, b := Pipe()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for {
+					if _, err := a.Write([]byte("x")); err != nil {
+						return
+					}
+				}
+			}()
+			go func() {
+				b.Read(make([]byte, 1))
+				b.CloseRead()
+				b.CloseWrite()
+			}()
+
+			Eventually(done).Should(BeClosed())
+			_, err := a.Read(make([]byte, 1))
+			Expect(err).To(Equal(io.EOF))
+			Expect(a.Close()).To(Succeed())
+			Expect(b.Close()).To(Succeed())
+		}
+	})
+})
+
+var _ = Describe("Compression", func() {
+	// compressedPipe returns a pipe whose writer compresses and records what it sends.
+	compressedPipe := func() (*MessagePort, *MessagePort, *recordingTransport) {
+		a, b := NewMemoryChannel()
+		t := &recordingTransport{Transport: b}
+		w := NewPort(t)
+		w.SetCompression(true)
+		r := NewPort(a)
+		Eventually(w.RemoteReady()).Should(Receive())
+		return r, w, t
+	}
+
+	It("compresses large writes", func() {
+		r, w, t := compressedPipe()
+		input := []byte(strings.Repeat(`{"key":"value","list":[1,2,3]},`, 64*1024))
+		c := readAll(r)
+
+		n, err := w.Write(input)
+		Expect(err).To(BeNil())
+		Expect(n).To(Equal(len(input)))
+		Expect(w.Close()).To(Succeed())
+
+		Eventually(c, 5*time.Second).Should(Receive(Equal(input)))
+		sent, deflated := t.stats()
+		Expect(sent).To(BeNumerically("<", len(input)/10))
+		Expect(deflated).To(BeNumerically(">", 1))
+	})
+
+	It("sends small writes as they are", func() {
+		r, w, t := compressedPipe()
+		c := readAll(r)
+
+		_, err := w.Write([]byte("small"))
+		Expect(err).To(BeNil())
+		Expect(w.Close()).To(Succeed())
+
+		Eventually(c, 5*time.Second).Should(Receive(Equal([]byte("small"))))
+		sent, deflated := t.stats()
+		Expect(sent).To(Equal(len("small")))
+		Expect(deflated).To(Equal(0))
+	})
+
+	It("sends writes before the remote end is ready as they are", func() {
+		a, b := NewMemoryChannel()
+		t := &recordingTransport{Transport: b}
+		w := NewPort(t)
+		w.SetCompression(true)
+		input := []byte(strings.Repeat("compressible text ", 1024))
+
+		errc := make(chan error, 1)
+		go func() {
+			_, err := w.Write(input)
+			errc <- err
+		}()
+		// The write is posted before the remote end tells that it accepts compressed writes.
+		Eventually(func() int {
+			sent, _ := t.stats()
+			return sent
+		}).Should(Equal(len(input)))
+
+		r := NewPort(a)
+		c := readAll(r)
+		Eventually(errc).Should(Receive(BeNil()))
+		Eventually(w.RemoteReady()).Should(Receive())
+		_, deflated := t.stats()
+		Expect(deflated).To(BeZero())
+
+		_, err := w.Write(input)
+		Expect(err).To(BeNil())
+		_, deflated = t.stats()
+		Expect(deflated).To(Equal(1))
+
+		Expect(w.Close()).To(Succeed())
+		Eventually(c).Should(Receive(Equal(append(input, input...))))
+	})
+
+	It("does not compress to a transport that drops the flag", func() {
+		a, b := NewMemoryChannel()
+		t := &recordingTransport{Transport: b}
+		w := NewPort(t)
+		w.SetCompression(true)
+		// An embedded Transport hides that the memory transport delivers the flag.
+		r := NewPort(struct{ Transport }{a})
+		Eventually(w.RemoteReady()).Should(Receive())
+		c := readAll(r)
+
+		input := []byte(strings.Repeat("compressible text ", 1024))
+		_, err := w.Write(input)
+		Expect(err).To(BeNil())
+		Expect(w.Close()).To(Succeed())
+
+		Eventually(c).Should(Receive(Equal(input)))
+		_, deflated := t.stats()
+		Expect(deflated).To(BeZero())
+	})
+
+	It("sends data that does not compress as it is", func() {
+		r, w, t := compressedPipe()
+		input := make([]byte, 64*1024)
+		rand.New(rand.NewSource(1)).Read(input)
+		c := readAll(r)
+
+		_, err := w.Write(input)
+		Expect(err).To(BeNil())
+		Expect(w.Close()).To(Succeed())
+
+		Eventually(c, 5*time.Second).Should(Receive(Equal(input)))
+		sent, deflated := t.stats()
+		Expect(sent).To(Equal(len(input)))
+		Expect(deflated).To(Equal(0))
+	})
+
+	It("rejects data that inflates too much", func() {
+		bomb, ok := deflate(make([]byte, 4*compressChunk))
+		Expect(ok).To(BeTrue())
+		_, err := inflate(bomb)
+		Expect(err).NotTo(BeNil())
+	})
+
+	It("compresses the streams of a call", func() {
+		input := strings.Repeat("compressible text ", 32*1024)
+		out := &buffer{}
+		Expect(wait(GoWith(strings.NewReader(input), out, upper, CallOptions{Compress: true}))).To(Succeed())
+		Expect(out.String()).To(Equal(strings.ToUpper(input)))
+	})
+})
+
+var _ = Describe("Calls", func() {
+	It("runs a call", func() {
+		out := &buffer{}
+		Expect(wait(Go(strings.NewReader("hello"), out, upper))).To(Succeed())
+		Expect(out.String()).To(Equal("HELLO"))
+		Expect(out.closed).To(BeTrue())
+	})
+
+	It("runs more calls than workers", func() {
+		var outs []*buffer
+		var handles []*Handle
+		for i := 0; i < memoryWorkerCount*3; i++ {
+			out := &buffer{}
+			outs = append(outs, out)
+			handles = append(handles, Go(strings.NewReader(fmt.Sprint("call ", i)), out, upper))
+		}
+		for i, h := range handles {
+			Expect(wait(h)).To(Succeed())
+			Expect(outs[i].String()).To(Equal(fmt.Sprint("CALL ", i)))
+		}
+	})
+
+	It("drops done messages for calls that were not scheduled", func() {
+		a, b := NewMemoryChannel()
+		port := NewPort(a)
+		Expect(b.Post(Message{Kind: MessageDone})).To(Succeed())
+		Consistently(port.callDone, 50*time.Millisecond).ShouldNot(Receive())
+
+		port.mu.Lock()
+		port.pendingCalls++
+		port.mu.Unlock()
+		Expect(b.Post(Message{Kind: MessageDone})).To(Succeed())
+		Eventually(port.callDone).Should(Receive())
+	})
+
+	It("chains calls", func() {
+		out := &buffer{}
+		Expect(wait(GoChain(strings.NewReader("abc"), out, upper, reverse))).To(Succeed())
+		Expect(out.String()).To(Equal("CBA"))
+	})
+
+	It("maps chunks in order", func() {
+		out := &buffer{}
+		opts := MapOptions{Ordered: true, MaxChunkSize: 4}
+		Expect(wait(GoMap(strings.NewReader("a\nb\nc\nd\n"), out, upper, opts))).To(Succeed())
+		Expect(out.String()).To(Equal("A\nB\nC\nD\n"))
+	})
+
+	It("maps chunks as they are done", func() {
+		out := &buffer{}
+		Expect(wait(GoMap(strings.NewReader("a\nb\nc\nd\n"), out, upper, MapOptions{}))).To(Succeed())
+		lines := strings.SplitAfter(out.String(), "\n")
+		Expect(lines[:len(lines)-1]).To(ConsistOf("A\n", "B\n", "C\n", "D\n"))
+		Expect(out.closed).To(BeTrue())
+	})
+
+	It("maps fixed size chunks", func() {
+		out := &buffer{}
+		opts := MapOptions{Split: ScanChunks(2), Ordered: true}
+		Expect(wait(GoMap(strings.NewReader("abcde"), out, upper, opts))).To(Succeed())
+		Expect(out.String()).To(Equal("ABCDE"))
+	})
+
+	It("fails on a chunk over the size limit", func() {
+		out := &buffer{}
+		err := wait(GoMap(strings.NewReader("abcdef\n"), out, upper, MapOptions{MaxChunkSize: 2}))
+		Expect(err).NotTo(BeNil())
+		Expect(err.Error()).To(ContainSubstring("error splitting input"))
+		Expect(out.closed).To(BeTrue())
+	})
+
+	It("stops mapping at the first failed chunk", func() {
+		// The input stays open, so the map only ends if it stops reading.
+		in, w := io.Pipe()
+		defer w.Close()
+		go w.Write([]byte("a\nb\n"))
+
+		out := &buffer{}
+		err := wait(GoMap(in, out, unregistered, MapOptions{Workers: 1}))
+		Expect(err).NotTo(BeNil())
+		Expect(err.Error()).To(ContainSubstring("is not registered"))
+		Expect(out.String()).To(BeEmpty())
+	})
+
+	It("passes shared values", func() {
+		wg := &sync.WaitGroup{}
+		wg.Add(memoryWorkerCount)
+
+		opts := CallOptions{Shared: map[string]Shareable{"wg": wg}}
+		for i := 0; i < memoryWorkerCount; i++ {
+			GoWith(nil, &buffer{}, done, opts)
+		}
+
+		waited := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(waited)
+		}()
+		Eventually(waited, 5*time.Second).Should(BeClosed())
+	})
+})
+
+// unregistered is not registered as a remote call.
+func unregistered(in io.Reader, out io.WriteCloser) {
+	out.Close()
+}
+
+// func1 is named like a closure.
+func func1(in io.Reader, out io.WriteCloser) {
+	out.Close()
+}
+
+// literal is a function literal that captures nothing.
+var literal = func(in io.Reader, out io.WriteCloser) {
+	out.Close()
+}
+
+// upperer has a method that could be used as a remote call.
+type upperer struct{}
+
+func (upperer) upper(in io.Reader, out io.WriteCloser) {
+	upper(in, out)
+}
+
+var _ = Describe("Graph", func() {
+	It("runs a chain of calls", func() {
+		g := NewGraph()
+		up := g.Call("upper", upper)
+		rev := g.Call("reverse", reverse)
+		g.Connect(g.Source(), up)
+		g.Connect(up, rev)
+		g.Connect(rev, g.Sink())
+
+		out := &buffer{}
+		Expect(wait(g.Run(strings.NewReader("abc"), out))).To(Succeed())
+		Expect(out.String()).To(Equal("CBA"))
+		Expect(out.closed).To(BeTrue())
+	})
+
+	It("runs a graph with tee and merge", func() {
+		g := NewGraph()
+		tee := g.Tee("tee")
+		up := g.Call("upper", upper)
+		rev := g.Call("reverse", reverse)
+		merge := g.Merge("merge")
+		g.Connect(g.Source(), tee)
+		g.Connect(tee, up)
+		g.Connect(tee, rev)
+		g.Connect(up, merge)
+		g.Connect(rev, merge)
+		g.Connect(merge, g.Sink())
+
+		out := &buffer{}
+		Expect(wait(g.Run(strings.NewReader("abc"), out))).To(Succeed())
+		Expect(out.String()).To(Equal("ABCcba"))
+	})
+
+	It("merges in the order the inputs were connected", func() {
+		g := NewGraph()
+		tee := g.Tee("tee")
+		up := g.Call("upper", upper)
+		rev := g.Call("reverse", reverse)
+		merge := g.Merge("merge")
+		g.Connect(g.Source(), tee)
+		g.Connect(tee, up)
+		g.Connect(tee, rev)
+		g.Connect(rev, merge)
+		g.Connect(up, merge)
+		g.Connect(merge, g.Sink())
+
+		out := &buffer{}
+		Expect(wait(g.Run(strings.NewReader("abc"), out))).To(Succeed())
+		Expect(out.String()).To(Equal("cbaABC"))
+	})
+
+	It("tees a stream larger than a pipe write", func() {
+		g := NewGraph()
+		tee := g.Tee("tee")
+		up := g.Call("upper", upper)
+		merge := g.Merge("merge")
+		g.Connect(g.Source(), tee)
+		g.Connect(tee, up)
+		g.Connect(tee, merge)
+		g.Connect(up, merge)
+		g.Connect(merge, g.Sink())
+
+		in := strings.Repeat("ab", 64<<10)
+		out := &buffer{}
+		Expect(wait(g.Run(strings.NewReader(in), out))).To(Succeed())
+		Expect(out.String()).To(Equal(in + strings.ToUpper(in)))
+	})
+
+	It("runs without input", func() {
+		g := NewGraph()
+		up := g.Call("upper", upper)
+		g.Connect(g.Source(), up)
+		g.Connect(up, g.Sink())
+
+		out := &buffer{}
+		Expect(wait(g.Run(nil, out))).To(Succeed())
+		Expect(out.String()).To(BeEmpty())
+		Expect(out.closed).To(BeTrue())
+	})
+
+	It("fails without output", func() {
+		g := NewGraph()
+		g.Connect(g.Source(), g.Sink())
+
+		err := wait(g.Run(strings.NewReader("abc"), nil))
+		Expect(errorx.IsOfType(err, errorx.IllegalArgument)).To(BeTrue())
+	})
+
+	It("reports every problem of an invalid graph", func() {
+		g := NewGraph()
+		a := g.Call("a", upper)
+		b := g.Call("b", upper)
+		g.Call("a", nil)
+		tee := g.Tee("tee")
+		other := NewGraph().Call("other", upper)
+		g.Connect(g.Source(), a)
+		g.Connect(a, b)
+		g.Connect(b, a)
+		g.Connect(tee, other)
+
+		err := g.Validate()
+		Expect(errorx.IsOfType(err, errorx.IllegalArgument)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring(`duplicate node name "a"`))
+		Expect(err.Error()).To(ContainSubstring(`node "a": must have a RemoteCall`))
+		Expect(err.Error()).To(ContainSubstring(`node "a": has 2 inputs, expected at most 1`))
+		Expect(err.Error()).To(ContainSubstring(`node "tee": unconnected input`))
+		Expect(err.Error()).To(ContainSubstring(`node "sink": unconnected input`))
+		Expect(err.Error()).To(ContainSubstring(`edge "tee" -> "other": node belongs to another graph`))
+		Expect(err.Error()).To(ContainSubstring("is part of a cycle"))
+
+		out := &buffer{}
+		Expect(wait(g.Run(strings.NewReader("abc"), out))).To(HaveOccurred())
+		Expect(out.closed).To(BeFalse())
+	})
+
+	It("accepts a valid graph", func() {
+		g := NewGraph()
+		tee := g.Tee("tee")
+		merge := g.Merge("merge")
+		g.Connect(g.Source(), tee)
+		g.Connect(tee, merge)
+		g.Connect(tee, merge)
+		g.Connect(merge, g.Sink())
+
+		Expect(g.Validate()).To(Succeed())
+	})
+
+	It("fails the graph with the error of a node", func() {
+		g := NewGraph()
+		tee := g.Tee("tee")
+		up := g.Call("upper", upper)
+		bad := g.Call("bad", unregistered)
+		merge := g.Merge("merge")
+		g.Connect(g.Source(), tee)
+		g.Connect(tee, up)
+		g.Connect(tee, bad)
+		g.Connect(up, merge)
+		g.Connect(bad, merge)
+		g.Connect(merge, g.Sink())
+
+		err := wait(g.Run(strings.NewReader("abc"), &buffer{}))
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(`node "bad"`))
+		Expect(err.Error()).To(ContainSubstring("is not registered"))
+	})
+})
+
+var _ = Describe("Faults", func() {
+	// deliver posts n data messages through a channel of f and returns what arrived.
+	deliver := func(f *FaultInjector, n int) []byte {
+		a, b := f.Channel()
+		c := collect(b)
+		for i := 0; i < n; i++ {
+			Expect(a.Post(Message{Kind: MessageData, Data: []byte{byte(i)}})).To(Succeed())
+		}
+		a.Close()
+
+		var got []byte
+		for {
+			select {
+			case msg := <-c:
+				got = append(got, msg.Data...)
+			case <-time.After(50 * time.Millisecond):
+				return got
+			}
+		}
+	}
+
+	It("injects the same faults for the same seed", func() {
+		opts := FaultOptions{
+			Seed:          7,
+			DropRate:      0.1,
+			DuplicateRate: 0.1,
+			ReorderRate:   0.1,
+			DelayRate:     0.1,
+			MaxDelay:      time.Millisecond,
+		}
+		first := deliver(NewFaultInjector(opts), 100)
+		Expect(deliver(NewFaultInjector(opts), 100)).To(Equal(first))
+
+		sent := make([]byte, 100)
+		for i := range sent {
+			sent[i] = byte(i)
+		}
+		Expect(first).NotTo(Equal(sent))
+	})
+
+	It("closes the wrapped transports when killed", func() {
+		f := NewFaultInjector(FaultOptions{})
+		a, b := f.Channel()
+		c := collect(b)
+		Expect(a.Post(Message{Kind: MessageData, Data: []byte("a")})).To(Succeed())
+		Eventually(c).Should(Receive())
+
+		f.Kill()
+		Expect(a.Post(Message{Kind: MessageData, Data: []byte("b")})).NotTo(Succeed())
+		Consistently(c, 50*time.Millisecond).ShouldNot(Receive())
+
+		a, _ = f.Channel()
+		Expect(a.Post(Message{Kind: MessageData})).NotTo(Succeed())
+	})
+
+	It("injects faults only into the given kinds", func() {
+		f := NewFaultInjector(FaultOptions{Kinds: []MessageKind{MessageAck}, DropRate: 1})
+		Expect(deliver(f, 10)).To(HaveLen(10))
+	})
+
+	It("times out a call whose input port never gets ready", func() {
+		f := NewFaultInjector(FaultOptions{Kinds: []MessageKind{MessageReady}, DropRate: 1})
+		restore := InjectFaults(f)
+		h := Go(strings.NewReader("hello"), &buffer{}, upper)
+		restore()
+
+		err := wait(h)
+		Expect(err).NotTo(BeNil())
+		Expect(errorx.IsOfType(err, errorx.TimeoutElapsed)).To(BeTrue(), err.Error())
+	})
+
+	It("fails a stalled write when the remote end closes", func() {
+		f := NewFaultInjector(FaultOptions{})
+		a, b := f.Channel()
+		w, r := NewPort(a), NewPort(b)
+		Eventually(w.RemoteReady()).Should(Receive())
+
+		f.StallAcks()
+		errc := make(chan error, 1)
+		go func() {
+			_, err := w.Write([]byte("data"))
+			errc <- err
+		}()
+
+		buf := make([]byte, 4)
+		_, err := io.ReadFull(r, buf)
+		Expect(err).To(BeNil())
+		Consistently(errc, 50*time.Millisecond).ShouldNot(Receive())
+
+		Expect(r.Close()).To(Succeed())
+		Eventually(errc).Should(Receive(Equal(io.EOF)))
+	})
+
+	It("fails a stalled write when the port is closed", func() {
+		f := NewFaultInjector(FaultOptions{})
+		a, b := f.Channel()
+		w, r := NewPort(a), NewPort(b)
+		Eventually(w.RemoteReady()).Should(Receive())
+
+		f.StallAcks()
+		errc := make(chan error, 1)
+		go func() {
+			_, err := w.Write([]byte("data"))
+			errc <- err
+		}()
+		Consistently(errc, 50*time.Millisecond).ShouldNot(Receive())
+
+		Expect(w.Close()).To(Succeed())
+		Eventually(errc).Should(Receive(Equal(io.ErrClosedPipe)))
+		Expect(r.Close()).To(Equal(io.EOF))
+	})
+
+	It("releases stalled acks", func() {
+		f := NewFaultInjector(FaultOptions{})
+		a, b := f.Channel()
+		w, r := NewPort(a), NewPort(b)
+		Eventually(w.RemoteReady()).Should(Receive())
+
+		f.StallAcks()
+		errc := make(chan error, 1)
+		go func() {
+			_, err := w.Write([]byte("data"))
+			errc <- err
+		}()
+		c := readAll(r)
+		Consistently(errc, 50*time.Millisecond).ShouldNot(Receive())
+
+		f.ReleaseAcks()
+		Eventually(errc).Should(Receive(BeNil()))
+		Expect(w.Close()).To(Succeed())
+		Eventually(c).Should(Receive(Equal([]byte("data"))))
+	})
+
+	It("stops a scheduler whose worker died mid-call", func() {
+		f := NewFaultInjector(FaultOptions{})
+		main, worker := f.Channel()
+		NewPort(worker)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s := NewScheduler()
+		stopped := make(chan error, 1)
+		go func() {
+			stopped <- s.RunScheduler(ctx, NewPort(main))
+		}()
+
+		restore := InjectFaults(f)
+		in, inWriter := Pipe()
+		h := newHandle()
+		call := newCall(h, in, &buffer{}, upper, false)
+		h.seal()
+		restore()
+		Expect(s.Call(ctx, call)).To(Succeed())
+
+		// The call runs once it reads its input.
+		_, err := inWriter.Write([]byte("a"))
+		Expect(err).To(BeNil())
+
+		// The input cannot be posted to the dead worker.
+		f.Kill()
+		_, err = inWriter.Write([]byte("b"))
+		Expect(errorx.IsOfType(err, errorx.IllegalState)).To(BeTrue())
+		Expect(h.Done()).NotTo(BeClosed())
+
+		cancel()
+		Eventually(stopped).Should(Receive(Equal(context.Canceled)))
+	})
+})
+
+var _ = Describe("Recording", func() {
+	// recordCall runs f on input with opts while recording
+	// and returns the records and the received call of f.
+	recordCall := func(input string, f RemoteCall, opts CallOptions) ([]Record, Record) {
+		var log bytes.Buffer
+		stop, err := StartRecording(&log)
+		Expect(err).To(BeNil())
+
+		out := &buffer{}
+		Expect(wait(GoWith(strings.NewReader(input), out, f, opts))).To(Succeed())
+		Expect(stop()).To(Succeed())
+
+		records, err := ReadRecords(&log)
+		Expect(err).To(BeNil())
+		for _, rec := range records {
+			if rec.Kind == MessageCall && rec.Dir == Received && rec.Call == funcName(f) {
+				return records, rec
+			}
+		}
+		Fail("the call was not recorded")
+		return nil, Record{}
+	}
+
+	It("records the messages of a call", func() {
+		records, call := recordCall("hello", upper, CallOptions{})
+		Expect(call.Input).NotTo(BeZero())
+		Expect(call.Output).NotTo(BeZero())
+
+		kinds := map[Direction]map[MessageKind]bool{Sent: {}, Received: {}}
+		for _, rec := range records {
+			Expect(rec.Time.IsZero()).To(BeFalse())
+			kinds[rec.Dir][rec.Kind] = true
+		}
+		for _, kind := range []MessageKind{MessageReady, MessageAck, MessageEOF, MessageData, MessageCall} {
+			Expect(kinds[Sent]).To(HaveKey(kind), kind.String())
+			Expect(kinds[Received]).To(HaveKey(kind), kind.String())
+		}
+	})
+
+	It("replays a recorded call", func() {
+		records, call := recordCall("hello", upper, CallOptions{})
+
+		out, err := Replay(records, call, upper)
+		Expect(err).To(BeNil())
+		Expect(string(out)).To(Equal("HELLO"))
+
+		out, err = Replay(records, call, reverse)
+		Expect(err).To(BeNil())
+		Expect(string(out)).To(Equal("olleh"))
+	})
+
+	It("replays compressed input", func() {
+		input := strings.Repeat("compressible text ", 4096)
+		records, call := recordCall(input, upper, CallOptions{Compress: true})
+
+		out, err := Replay(records, call, upper)
+		Expect(err).To(BeNil())
+		Expect(string(out)).To(Equal(strings.ToUpper(input)))
+	})
+
+	It("replays only received calls", func() {
+		_, err := Replay(nil, Record{Kind: MessageData, Dir: Received}, upper)
+		Expect(err).NotTo(BeNil())
+	})
+
+	It("runs one recording at a time", func() {
+		stop, err := StartRecording(ioutil.Discard)
+		Expect(err).To(BeNil())
+		_, err = StartRecording(ioutil.Discard)
+		Expect(err).NotTo(BeNil())
+		Expect(stop()).To(Succeed())
+	})
+
+	It("rejects an invalid recording", func() {
+		_, err := ReadRecords(strings.NewReader(`{"kind":"unknown"}`))
+		Expect(err).NotTo(BeNil())
+		_, err = ReadRecords(strings.NewReader(`{"kind":"data"`))
+		Expect(err).NotTo(BeNil())
+	})
+})
+
+var _ = Describe("Topics", func() {
+	// subscribe subscribes with a buffer of one message and waits
+	// until the goroutine of the subscription holds the first message.
+	subscribe := func(topic string, overflow Overflow) *Subscription {
+		sub := Subscribe(topic, SubscribeOptions{Buffer: 1, Overflow: overflow})
+		Expect(Publish(topic, []byte("a"))).To(Succeed())
+		Eventually(func() int { return len(sub.queue) }).Should(BeZero())
+		Expect(Publish(topic, []byte("b"))).To(Succeed())
+		return sub
+	}
+
+	subscribed := func(topic string) bool {
+		topics.mu.Lock()
+		defer topics.mu.Unlock()
+		_, ok := topics.topics[topic]
+		return ok
+	}
+
+	It("blocks Publish until the subscriber has room", func() {
+		sub := subscribe("block", OverflowBlock)
+		defer sub.Close()
+
+		published := make(chan struct{})
+		go func() {
+			defer close(published)
+			Publish("block", []byte("c"))
+		}()
+		Consistently(published, 100*time.Millisecond).ShouldNot(BeClosed())
+
+		Expect(<-sub.C()).To(Equal([]byte("a")))
+		Eventually(published, 5*time.Second).Should(BeClosed())
+		Expect(<-sub.C()).To(Equal([]byte("b")))
+		Expect(<-sub.C()).To(Equal([]byte("c")))
+	})
+
+	It("blocks a publish from another thread until the subscriber has room", func() {
+		sub := subscribe("remote", OverflowBlock)
+		defer sub.Close()
+
+		// The link delivers to the subscribers of this process.
+		a, b := NewMemoryChannel()
+		link := NewPort(a)
+		NewPort(b)
+
+		published := make(chan error, 1)
+		go func() {
+			published <- link.publish("remote", []byte("c"))
+		}()
+		Consistently(published, 100*time.Millisecond).ShouldNot(Receive())
+
+		Expect(<-sub.C()).To(Equal([]byte("a")))
+		Eventually(published, 5*time.Second).Should(Receive(BeNil()))
+		Expect(<-sub.C()).To(Equal([]byte("b")))
+		Expect(<-sub.C()).To(Equal([]byte("c")))
+	})
+
+	It("fails a publish to a closed link", func() {
+		a, b := NewMemoryChannel()
+		link := NewPort(a)
+		Expect(NewPort(b).Close()).To(Succeed())
+		Eventually(link.ctx.Done(), 5*time.Second).Should(BeClosed())
+
+		Expect(link.publish("closed", []byte("a"))).NotTo(Succeed())
+	})
+
+	It("drops messages for a full subscriber", func() {
+		sub := subscribe("drop", OverflowDrop)
+		defer sub.Close()
+
+		Expect(Publish("drop", []byte("c"))).To(Succeed())
+
+		Expect(<-sub.C()).To(Equal([]byte("a")))
+		Expect(<-sub.C()).To(Equal([]byte("b")))
+		Consistently(sub.C(), 100*time.Millisecond).ShouldNot(Receive())
+		Expect(sub.Err()).To(BeNil())
+	})
+
+	It("disconnects a full subscriber", func() {
+		sub := subscribe("disconnect", OverflowDisconnect)
+
+		Expect(Publish("disconnect", []byte("c"))).To(Succeed())
+
+		Eventually(sub.C(), 5*time.Second).Should(BeClosed())
+		Expect(sub.Err()).To(Equal(ErrSlowSubscriber))
+		Expect(subscribed("disconnect")).To(BeFalse())
+	})
+
+	It("does not hold back the other subscribers", func() {
+		slow := subscribe("slow", OverflowDrop)
+		defer slow.Close()
+		fast := Subscribe("slow", SubscribeOptions{Buffer: 4})
+		defer fast.Close()
+
+		for _, msg := range []string{"c", "d", "e"} {
+			Expect(Publish("slow", []byte(msg))).To(Succeed())
+			Expect(<-fast.C()).To(Equal([]byte(msg)))
+		}
+	})
+
+	It("removes the topic when the last subscriber leaves", func() {
+		a := Subscribe("leave", SubscribeOptions{})
+		b := Subscribe("leave", SubscribeOptions{})
+
+		a.Close()
+		Expect(subscribed("leave")).To(BeTrue())
+		b.Close()
+		Expect(subscribed("leave")).To(BeFalse())
+
+		Eventually(a.C(), 5*time.Second).Should(BeClosed())
+		Eventually(b.C(), 5*time.Second).Should(BeClosed())
+		Expect(Publish("leave", []byte("a"))).To(Succeed())
+	})
+})
+
+var _ = Describe("Registry", func() {
+	It("fails to call an unregistered function", func() {
+		err := wait(Go(nil, &buffer{}, unregistered))
+		Expect(err).NotTo(BeNil())
+		Expect(err.Error()).To(ContainSubstring("is not registered"))
+	})
+
+	It("fails to call a closure that captures state", func() {
+		suffix := "!"
+		closure := func(in io.Reader, out io.WriteCloser) {
+			defer out.Close()
+			out.Write([]byte(suffix))
+		}
+		Register(closure)
+
+		err := wait(Go(nil, &buffer{}, closure))
+		Expect(err).NotTo(BeNil())
+		Expect(err.Error()).To(ContainSubstring("is a closure that captures state"))
+
+		err = wait(GoChain(strings.NewReader(""), &buffer{}, upper, closure))
+		Expect(err).NotTo(BeNil())
+		Expect(err.Error()).To(ContainSubstring("is a closure that captures state"))
+	})
+
+	It("fails to call a method value", func() {
+		f := upperer{}.upper
+		Register(f)
+
+		err := wait(Go(nil, &buffer{}, f))
+		Expect(err).NotTo(BeNil())
+		Expect(err.Error()).To(ContainSubstring("is a method value"))
+	})
+
+	It("calls a function literal in a package variable", func() {
+		Register(literal)
+
+		Expect(wait(Go(nil, &buffer{}, literal))).To(Succeed())
+	})
+
+	It("calls a function literal that captures nothing", func() {
+		f := func(in io.Reader, out io.WriteCloser) {
+			defer out.Close()
+			out.Write([]byte("ran"))
+		}
+		Register(f)
+
+		out := &buffer{}
+		Expect(wait(Go(nil, out, f))).To(Succeed())
+		Expect(out.String()).To(Equal("ran"))
+	})
+
+	It("accepts static function values", func() {
+		Expect(checkStatic(upper)).To(Succeed())
+		Expect(checkStatic(func1)).To(Succeed())
+		Expect(checkStatic(literal)).To(Succeed())
+		Expect(checkStatic(func(in io.Reader, out io.WriteCloser) { out.Close() })).To(Succeed())
+	})
+
+	It("rejects an unregistered call on the worker", func() {
+		main, worker := NewMemoryChannel()
+		NewPort(worker)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s := NewScheduler()
+		go s.RunScheduler(ctx, NewPort(main))
+
+		local, remote := Pipe()
+		Expect(s.Call(ctx, Call{RemoteCall: unregistered, Output: remote})).To(Succeed())
+
+		// The worker closes the output without running the call.
+		_, err := local.Read(make([]byte, 1))
+		Expect(err).To(Equal(io.EOF))
+
+		// And releases the scheduler for the next call.
+		local, remote = Pipe()
+		Expect(s.Call(ctx, Call{RemoteCall: done, Output: remote})).To(Succeed())
+		Eventually(readAll(local), 5*time.Second).Should(Receive(BeEmpty()))
+	})
+})
+
+var _ = Describe("Services", func() {
+	It("opens a stream to a local service", func() {
+		Expect(RegisterService("echo", func(conn io.ReadWriteCloser) {
+			defer conn.Close()
+			b := make([]byte, 4)
+			n, _ := conn.Read(b)
+			conn.Write(bytes.ToUpper(b[:n]))
+		})).To(Succeed())
+		defer UnregisterService("echo")
+		Expect(RegisterService("echo", func(io.ReadWriteCloser) {})).NotTo(Succeed())
+
+		conn, err := OpenService(context.Background(), "echo")
+		Expect(err).To(BeNil())
+		_, err = conn.Write([]byte("ping"))
+		Expect(err).To(BeNil())
+		b, err := ioutil.ReadAll(conn)
+		Expect(err).To(BeNil())
+		Expect(string(b)).To(Equal("PING"))
+	})
+
+	It("waits until the service is registered", func() {
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			RegisterService("late", func(conn io.ReadWriteCloser) { conn.Close() })
+		}()
+		defer UnregisterService("late")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := OpenServiceOn(ctx, WorkerID(), "late")
+		Expect(err).To(BeNil())
+
+		short, cancelShort := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancelShort()
+		_, err = OpenService(short, "missing")
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("Page sessions", func() {
+	// connect connects a page with its own scheduler to a shared worker session.
+	connect := func(ctx context.Context) (*MessagePort, *Scheduler) {
+		host, page := NewMemoryChannel()
+		pages.accept(host)
+		port := NewPort(page)
+		s := NewScheduler()
+		go s.RunScheduler(ctx, port)
+		return port, s
+	}
+
+	// call schedules f with s.
+	call := func(s *Scheduler, in io.Reader, out io.WriteCloser, f RemoteCall) *Handle {
+		h := newHandle()
+		defer h.seal()
+		c := newCall(h, in, out, f, false)
+		h.run(func() error {
+			return s.Call(context.Background(), c)
+		})
+		return h
+	}
+
+	It("runs the calls of each page on the shared worker", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		before := pages.count()
+		var handles []*Handle
+		var outs []*buffer
+		for i := 0; i < 3; i++ {
+			_, s := connect(ctx)
+			out := &buffer{}
+			outs = append(outs, out)
+			handles = append(handles, call(s, strings.NewReader(fmt.Sprint("page ", i)), out, upper))
+		}
+		Expect(pages.count()).To(Equal(before + 3))
+
+		for i, h := range handles {
+			Expect(wait(h)).To(Succeed())
+			Expect(outs[i].String()).To(Equal(fmt.Sprint("PAGE ", i)))
+		}
+	})
+
+	It("stops the calls of a page that disconnects", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		before := pages.count()
+		port, s := connect(ctx)
+		Eventually(pages.count).Should(Equal(before + 1))
+
+		r, w := io.Pipe()
+		h := call(s, nil, w, flood)
+		// Wait for the call to run.
+		_, err := r.Read(make([]byte, 1))
+		Expect(err).To(BeNil())
+		go io.Copy(ioutil.Discard, r)
+
+		Expect(port.Close()).To(Succeed())
+		Eventually(flooded, 5*time.Second).Should(Receive(HaveOccurred()))
+		Eventually(pages.count, 5*time.Second).Should(Equal(before))
+		Expect(wait(h)).To(Succeed())
+	})
+
+	Context("with a short page timeout", func() {
+		var timeout time.Duration
+
+		BeforeEach(func() {
+			timeout = PageTimeout
+			PageTimeout = 100 * time.Millisecond
+		})
+
+		AfterEach(func() {
+			PageTimeout = timeout
+		})
+
+		It("stops the calls of a page that goes away without closing its port", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			before := pages.count()
+			_, s := connect(ctx)
+			Eventually(pages.count).Should(Equal(before + 1))
+
+			r, w := io.Pipe()
+			h := call(s, nil, w, flood)
+			_, err := r.Read(make([]byte, 1))
+			Expect(err).To(BeNil())
+			go io.Copy(ioutil.Discard, r)
+
+			// The page does not ping.
+			Eventually(flooded, 5*time.Second).Should(Receive(HaveOccurred()))
+			Eventually(pages.count, 5*time.Second).Should(Equal(before))
+			Expect(wait(h)).To(Succeed())
+		})
+
+		It("keeps the session of a page that pings", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			before := pages.count()
+			port, _ := connect(ctx)
+			go ping(port, PageTimeout)
+			Consistently(pages.count, 5*PageTimeout).Should(Equal(before + 1))
+
+			Expect(port.Close()).To(Succeed())
+			Eventually(pages.count, 5*time.Second).Should(Equal(before))
+		})
+	})
+})
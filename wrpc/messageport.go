@@ -1,26 +1,23 @@
-// +build js,wasm
-
 package wrpc
 
 import (
 	"context"
 	"io"
-	"runtime"
+	"sync"
 	"sync/atomic"
-	"syscall/js"
 
 	"github.com/joomcode/errorx"
-	"github.com/mgnsk/jsutil"
-	"github.com/mgnsk/jsutil/array"
+	"github.com/mgnsk/jsutil/logger"
 )
 
-// MessagePort enables duplex communication with any js object
-// implementing the onmessage event and postMessage method.
+// MessagePort enables duplex communication over a Transport,
+// for example a js object implementing the onmessage event and postMessage method.
 type MessagePort struct {
-	// JS MessagePort object.
-	value js.Value
+	t Transport
+	// id identifies the port in recordings.
+	id uint64
 
-	// A writer where onmessage event handler writes to.
+	// A writer where the message handler writes to.
 	recvWriter *io.PipeWriter
 	// A reader from where messages written to recvWriter can be read from.
 	recvReader *io.PipeReader
@@ -30,237 +27,587 @@ type MessagePort struct {
 
 	ack chan struct{}
 
-	// isEOF when true, indicates that remote side closed its port.
-	isEOF bool
-	// isClosed indicates that the port was closed from this side.
-	isClosed bool
+	// callDone receives when a call scheduled to this port is done.
+	callDone chan struct{}
+
+	mu    sync.Mutex
+	state portState
+	// shut are the closed directions of a half-closed port.
+	shut shutFlags
+	// err is the error of an errored port.
+	err error
+	// pendingCalls is the number of calls scheduled to this port that are not done yet.
+	pendingCalls int
+	// compress enables the compression of writes.
+	compress bool
+	// remoteInflates is true when the remote end accepts compressed writes.
+	remoteInflates bool
+
+	// publishMu serializes the topic messages posted to a link,
+	// since they are acked like writes.
+	publishMu sync.Mutex
+
+	// writeMu serializes writes so that at most one data message waits for its ack.
+	writeMu sync.Mutex
+	// ackDue is true when the ack of a write that timed out has not arrived yet.
+	// It is guarded by writeMu.
+	ackDue bool
+
+	// sendMu orders the data messages with the EOF of CloseWrite and Close,
+	// so that no data is posted after them.
+	sendMu sync.Mutex
+
+	readDeadline, writeDeadline *deadline
+
+	// readMu serializes reads.
+	readMu sync.Mutex
+	// reading receives the result of a read that outlived its deadline.
+	reading chan readResult
+	// unread is the data of a read that did not fit the buffer of the next read.
+	unread []byte
+
+	// shared values of the call this port belongs to.
+	shared map[string]interface{}
+
+	// output receives the output forwarded from a worker.
+	// It must be set before the port starts.
+	output func(Message)
+
+	// session runs the calls received from a page of a shared worker.
+	// It must be set before the port starts.
+	session *pageSession
 
 	// Context that is canceled when port is closed.
 	ctx    context.Context
 	cancel context.CancelFunc
+
+	// startOnce starts listening on the transport.
+	startOnce sync.Once
 }
 
 // Pipe returns a message channel pipe connection between ports.
+// The ports start listening when they are first used on this thread,
+// so an unused port can be passed to a call with all its messages.
 func Pipe() (*MessagePort, *MessagePort) {
-	ch := js.Global().Get("MessageChannel").New()
-	return NewMessagePort(ch.Get("port1")), NewMessagePort(ch.Get("port2"))
+	channelMu.RLock()
+	create := newChannel
+	channelMu.RUnlock()
+
+	t1, t2 := create()
+	return newPort(t1), newPort(t2)
 }
 
-// NewMessagePort constructor.
-func NewMessagePort(value js.Value) *MessagePort {
+// NewPort creates a port that listens on t.
+func NewPort(t Transport) *MessagePort {
+	port := newPort(t)
+	port.start()
+	return port
+}
+
+// newPort creates a port that starts listening on first use.
+func newPort(t Transport) *MessagePort {
 	recvReader, recvWriter := io.Pipe()
 	ctx, cancel := context.WithCancel(context.Background())
-	port := &MessagePort{
-		value:       value,
-		recvReader:  recvReader,
-		recvWriter:  recvWriter,
-		remoteReady: make(chan struct{}),
-		ack:         make(chan struct{}),
-		ctx:         ctx,
-		cancel:      cancel,
+	return &MessagePort{
+		t:             t,
+		id:            nextPortID(),
+		recvReader:    recvReader,
+		recvWriter:    recvWriter,
+		remoteReady:   make(chan struct{}),
+		ack:           make(chan struct{}),
+		callDone:      make(chan struct{}),
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+		ctx:           ctx,
+		cancel:        cancel,
 	}
+}
 
-	onerror, onmessage, onmessageerror := port.getEventHandlers()
-
-	port.value.Set("onerror", onerror)
-	port.value.Set("onmessage", onmessage)
-	port.value.Set("onmessageerror", onmessageerror)
-
-	port.notifyReady()
-
-	// Clean up when port is not used anymore.
-	runtime.SetFinalizer(port, func(p *MessagePort) {
-		onerror.Release()
-		onmessage.Release()
-		onmessageerror.Release()
+// start listens on the transport and lets the remote end know we are listening.
+func (port *MessagePort) start() {
+	port.startOnce.Do(func() {
+		port.t.Listen(port.handle)
+		// Accept compressed writes only when the transport delivers their flag.
+		port.post(Message{Kind: MessageReady, Deflate: carriesDeflate(port.t)})
 	})
+}
 
-	return port
+// Transport returns the transport of the port.
+func (port *MessagePort) Transport() Transport {
+	return port.t
 }
 
-// setEventHandlers sets the handlers for incoming messages and error handling.
-func (port *MessagePort) getEventHandlers() (onerror, onmessage, onmessageerror js.Func) {
-	onerror = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
-		jsutil.ConsoleLog("MessagePort: onerror:", args[0])
-		return nil
-	})
+// handle handles the incoming messages.
+func (port *MessagePort) handle(msg Message) {
+	if msg.Kind != MessageCall || msg.Err != nil {
+		// Received calls are recorded with their ports.
+		record(newRecord(port, Received, msg))
+	}
 
-	onmessage = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
-		// TODO assert that args are valid.
-		data := args[0].Get("data")
+	if port.session != nil {
+		// Any message tells that the page is still there.
+		port.session.touch()
+	}
 
-		if data.Get("ready") != js.Undefined() {
-			go func() {
-				port.remoteReady <- struct{}{}
-			}()
-			return nil
+	if msg.Err != nil {
+		logger.Error("wrpc: MessagePort: invalid message", logger.F("err", msg.Err))
+		switch msg.Kind {
+		case MessageData:
+			// Fail the reader of this port and release the writer.
+			port.fail(msg.Err)
+			port.post(Message{Kind: MessageAck})
+		case MessageCall:
+			if acceptCalls && msg.Call != nil {
+				port.reject(msg.Call)
+			}
 		}
+		return
+	}
 
-		if data.Get("ack") != js.Undefined() {
-			go func() {
-				port.ack <- struct{}{}
-			}()
-			return nil
+	switch msg.Kind {
+	case MessageReady:
+		port.mu.Lock()
+		port.remoteInflates = msg.Deflate
+		port.mu.Unlock()
+		go func() {
+			port.remoteReady <- struct{}{}
+		}()
+
+	case MessageAck:
+		go func() {
+			port.ack <- struct{}{}
+		}()
+
+	case MessageDone:
+		port.mu.Lock()
+		expected := port.pendingCalls > 0
+		if expected {
+			port.pendingCalls--
+		}
+		port.mu.Unlock()
+		if !expected {
+			// A done for a call that was not scheduled here must not release the scheduler.
+			logger.Error("wrpc: MessagePort: unexpected done message")
+			return
+		}
+		go func() {
+			port.callDone <- struct{}{}
+		}()
+
+	case MessageEOF:
+		switch msg.Shutdown {
+		case ShutdownWrite:
+			// The remote end does not write anymore. The reader gets an EOF.
+			port.mu.Lock()
+			port.shutLocked(remoteShutWrite)
+			port.mu.Unlock()
+			port.recvWriter.Close()
+			return
+		case ShutdownRead:
+			// The remote end does not read anymore. Writes get an EOF.
+			port.mu.Lock()
+			port.shutLocked(remoteShutRead)
+			port.mu.Unlock()
+			return
 		}
 
 		// Handle port close from other side and start emitting EOF.
-		EOF := data.Get("EOF")
-		if EOF != js.Undefined() {
-			// Set the EOF flag for Write. It does not use the pipe.
-			port.isEOF = true
-			port.cancel()
-			// Close only writer. reader will get an EOF.
-			port.recvWriter.Close()
-			port.value.Call("close")
-			return nil
+		port.mu.Lock()
+		ok := port.setStateLocked(portEOF)
+		port.mu.Unlock()
+		if !ok {
+			// The port was closed from this side.
+			return
+		}
+		port.cancel()
+		// Close only writer. reader will get an EOF.
+		port.recvWriter.Close()
+		port.t.Close()
+
+	case MessageTopic:
+		go func() {
+			// Ack when there is room, so that the publisher waits for blocking subscribers.
+			defer port.post(Message{Kind: MessageAck})
+			topics.deliver(msg.Topic, msg.Data)
+		}()
+
+	case MessageHello:
+		greet(port, msg.ID)
+
+	case MessageService:
+		if msg.Service != nil {
+			services.update(msg.ID, msg.Service)
 		}
 
-		// Remote call.
-		rc := data.Get("rc")
-		if jsutil.IsWorker && rc != js.Undefined() {
-
-			call := newCallFromJS(
-				data.Get("rc"),
-				data.Get("input"),
-				data.Get("output"),
-			)
-
-			// Currently allow 1 concurrent call per worker.
-			// TODO configure this on runtime.
-			// It can happen if multiple ports are scheduling into this one.
-			if atomic.AddUint64(&CallCount, 1) > 1 {
-				jsutil.ConsoleLog("Rescheduling...")
-				// Reschedule until we have a free worker.
-				go GlobalScheduler.Call(context.TODO(), call)
-				return nil
-			}
+	case MessageOpen:
+		if msg.Service != nil && msg.Service.Conn != nil {
+			serveStream(msg.Service)
+		}
+
+	case MessageOutput, MessageLog:
+		if port.output != nil {
+			port.output(msg)
+		}
 
-			// Notify the caller to send input now as we have set up event handlers.
+	case MessagePing:
+		// The session of a page was touched above.
+
+	case MessageCall:
+		if acceptCalls && msg.Call != nil {
+			call := newCallFromMessage(msg.Call)
+			rec := newRecord(port, Received, msg)
+			rec.Output = call.Output.id
 			if call.Input != nil {
-				ack(call.Input.JSValue())
+				rec.Input = call.Input.id
 			}
-
-			go call.exec(func() {
-				//	atomic.AddUint64(&CallCount, ^uint64(0))
-				// Ack call output when call finished.
-				ack(call.Output.JSValue())
-			})
-			return nil
+			record(rec)
+			port.serve(call)
 		}
 
-		// ArrayBuffer data message.
-		arr := data.Get("arr")
-		if arr != js.Undefined() {
-			go func() {
-				// Ack enables blocking write calls on the other side.
-				defer ack(port.value)
-
-				recvBytes, err := array.Buffer(arr).CopyBytes()
-				if err != nil {
-					errorx.Panic(errorx.Decorate(err, "copyBytes: error"))
-				} else if len(recvBytes) == 0 {
-					errorx.Panic(errorx.InternalError.New("copyBytes: 0 bytes"))
+	case MessageData:
+		go func() {
+			// Ack enables blocking write calls on the other side.
+			defer port.post(Message{Kind: MessageAck})
+
+			if len(msg.Data) == 0 {
+				// Empty writes carry no data.
+				return
+			}
+
+			data := msg.Data
+			if msg.Deflate {
+				var err error
+				if data, err = inflate(data); err != nil {
+					port.fail(err)
+					return
 				}
+			}
 
-				if n, err := port.recvWriter.Write(recvBytes); err == io.ErrClosedPipe {
-					// This side of the port was closed. Notify other side.
-					port.notifyEOF()
-				} else if err == io.EOF {
-					// Other side of port was closed. Close call was already handled.
-				} else if err != nil {
-					errorx.Panic(errorx.Decorate(err, "recvWriter: write error"))
-				} else if n == 0 {
-					errorx.Panic(errorx.InternalError.New("recvWriter: 0 bytes"))
+			if _, err := port.recvWriter.Write(data); err == io.ErrClosedPipe {
+				port.mu.Lock()
+				readOnly := port.shut&shutRead != 0 && port.state != portClosed
+				port.mu.Unlock()
+				if readOnly {
+					// This side stopped reading. Drop the data.
+					return
 				}
-			}()
-			return nil
-		}
+				// This side of the port was closed. Notify other side.
+				port.notifyEOF()
+			} else if err == io.EOF {
+				// Other side of port was closed. Close call was already handled.
+			} else if err != nil {
+				port.recvWriter.CloseWithError(errorx.Decorate(err, "recvWriter: write error"))
+			}
+		}()
+	}
+}
 
-		return nil
-	})
+// serve runs a call received on the port.
+func (port *MessagePort) serve(call Call) {
+	if err := checkRegistered(call.RemoteCall); err != nil {
+		logger.Error("wrpc: rejected call", logger.F("err", err))
+		port.reject(call.message())
+		return
+	}
 
-	onmessageerror = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
-		jsutil.ConsoleLog("MessagePort: onmessageerror:", args[0])
-		return nil
+	if port.session != nil {
+		// Pages get their own session and are not rescheduled.
+		port.session.run(call)
+		return
+	}
+
+	if call.pinned {
+		// Pinned calls are posted past the scheduler of this port.
+		atomic.AddUint64(&CallCount, 1)
+		go call.exec(func() {
+			atomic.AddUint64(&CallCount, ^uint64(0))
+		})
+		return
+	}
+
+	// It can happen if multiple ports are scheduling into this one.
+	if atomic.AddUint64(&CallCount, 1) > maxCalls {
+		atomic.AddUint64(&CallCount, ^uint64(0))
+		logger.Debug("wrpc: rescheduling call")
+		// Reschedule until we have a free worker.
+		go func() {
+			GlobalScheduler.Call(context.TODO(), call)
+			// The call was handed off.
+			port.post(Message{Kind: MessageDone})
+		}()
+		return
+	}
+
+	go call.exec(func() {
+		atomic.AddUint64(&CallCount, ^uint64(0))
+		// Let the scheduler of this port continue.
+		port.post(Message{Kind: MessageDone})
 	})
+}
 
-	return onerror, onmessage, onmessageerror
+// reject closes the ports of a call that will not run
+// and releases the scheduler that posted it.
+func (port *MessagePort) reject(m *CallMessage) {
+	for _, t := range []Transport{m.Input, m.Output} {
+		if t != nil {
+			NewPort(t).Close()
+		}
+	}
+	if !m.Pinned {
+		port.post(Message{Kind: MessageDone})
+	}
 }
 
 // Read from port.
 func (port *MessagePort) Read(p []byte) (n int, err error) {
-	return port.recvReader.Read(p)
+	port.start()
+
+	port.readMu.Lock()
+	defer port.readMu.Unlock()
+
+	expired := port.readDeadline.wait()
+	if isClosedChan(expired) {
+		return 0, ErrDeadlineExceeded
+	}
+
+	if len(port.unread) > 0 {
+		port.mu.Lock()
+		closed := port.state == portClosed || port.shut&shutRead != 0
+		port.mu.Unlock()
+		if closed {
+			port.unread = nil
+			return 0, io.ErrClosedPipe
+		}
+		n = copy(p, port.unread)
+		port.unread = port.unread[n:]
+		return n, nil
+	}
+
+	if port.reading == nil {
+		// Read the pipe in a goroutine so that the deadline can interrupt the wait.
+		// The buffer is its own since p belongs to the caller when the read times out.
+		buf := make([]byte, len(p))
+		reading := make(chan readResult, 1)
+		go func() {
+			n, err := port.recvReader.Read(buf)
+			reading <- readResult{data: buf[:n], err: err}
+		}()
+		port.reading = reading
+	}
+
+	select {
+	case res := <-port.reading:
+		port.reading = nil
+		n = copy(p, res.data)
+		port.unread = res.data[n:]
+		return n, res.err
+	case <-expired:
+		return 0, ErrDeadlineExceeded
+	}
 }
 
 // Write to port.
 func (port *MessagePort) Write(p []byte) (n int, err error) {
+	port.start()
+
+	port.writeMu.Lock()
+	defer port.writeMu.Unlock()
+
 	// Since we don't use a pipe on the write side,
 	// we have to rely on manual signaling.
-	if port.isEOF {
-		return 0, io.EOF
-	} else if port.isClosed {
-		return 0, io.ErrClosedPipe
+	port.mu.Lock()
+	err = port.writeErrLocked()
+	port.mu.Unlock()
+
+	if err != nil {
+		return 0, err
+	} else if isClosedChan(port.writeDeadline.wait()) {
+		return 0, ErrDeadlineExceeded
+	} else if len(p) == 0 {
+		return 0, nil
+	}
+
+	if !port.compressing(p) {
+		return port.send(Message{Kind: MessageData, Data: p}, len(p))
 	}
 
-	arr, err := array.CreateBufferFromSlice(p)
+	// Compress in chunks so that the receiver can bound the inflated size.
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > compressChunk {
+			chunk = chunk[:compressChunk]
+		}
+		msg := Message{Kind: MessageData, Data: chunk}
+		if deflated, ok := deflate(chunk); ok {
+			msg.Data, msg.Deflate = deflated, true
+		}
+		k, err := port.send(msg, len(chunk))
+		n += k
+		if err != nil {
+			return n, err
+		}
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+// send posts a data message carrying n bytes of a write and waits for the ack.
+// A message that was posted is read by the remote end, so n is returned
+// even when the ack times out. port.writeMu must be held.
+func (port *MessagePort) send(msg Message, n int) (int, error) {
+	expired := port.writeDeadline.wait()
+
+	if port.ackDue {
+		// Wait for the ack of the write that timed out so that it does not complete this one.
+		if err := port.waitAck(expired); err != nil {
+			return 0, err
+		}
+		port.ackDue = false
+	}
+	if isClosedChan(expired) {
+		return 0, ErrDeadlineExceeded
+	}
+
+	// Check the state again in order with Close so that the data is not posted after an EOF.
+	port.sendMu.Lock()
+	port.mu.Lock()
+	err := port.writeErrLocked()
+	port.mu.Unlock()
+	if err == nil {
+		err = port.postMessage(msg)
+	}
+	port.sendMu.Unlock()
 	if err != nil {
 		return 0, err
 	}
 
-	messages := map[string]interface{}{"arr": arr}
-	transferables := []interface{}{arr}
-	port.PostMessage(messages, transferables)
-	<-port.ack
-	return len(p), nil
+	if err := port.waitAck(expired); err != nil {
+		if err == ErrDeadlineExceeded {
+			port.ackDue = true
+			return n, err
+		}
+		return 0, err
+	}
+	return n, nil
+}
+
+// waitAck waits for the ack of the data message in flight.
+func (port *MessagePort) waitAck(expired <-chan struct{}) error {
+	select {
+	case <-port.ack:
+		return nil
+	case <-expired:
+		return ErrDeadlineExceeded
+	case <-port.ctx.Done():
+		// The port was closed before the remote end read the data.
+		port.mu.Lock()
+		defer port.mu.Unlock()
+		if port.state == portClosed {
+			return io.ErrClosedPipe
+		}
+		return io.EOF
+	}
 }
 
 // Close the port.
 func (port *MessagePort) Close() error {
-	if port.isEOF {
+	port.start()
+
+	port.mu.Lock()
+	switch port.state {
+	case portEOF:
+		port.mu.Unlock()
 		return io.EOF
-	} else if port.isClosed {
+	case portClosed:
+		port.mu.Unlock()
 		return io.ErrClosedPipe
 	}
-
 	// Let port.Write know we are closed.
-	port.isClosed = true
+	port.setStateLocked(portClosed)
+	port.mu.Unlock()
+
 	// Stop schedulers to this port.
 	port.cancel()
-	// Notify remote end of EOF.
+	// Notify remote end of EOF after the data being posted.
+	port.sendMu.Lock()
 	port.notifyEOF()
+	port.sendMu.Unlock()
 	port.recvReader.Close()
 	port.recvWriter.Close()
-	port.value.Call("close")
+	port.t.Close()
 	return nil
 }
 
-// JSValue returns the underlying js value.
-func (port *MessagePort) JSValue() js.Value {
-	if port == nil {
-		return js.Null()
+// CloseWrite closes the writing direction of the port.
+// The remote end reads an EOF after the data written so far
+// and can still write to this end. Writes fail with io.ErrClosedPipe.
+// Close must still be called to release the port.
+func (port *MessagePort) CloseWrite() error {
+	return port.shutdown(ShutdownWrite)
+}
+
+// CloseRead closes the reading direction of the port.
+// Reads fail with io.ErrClosedPipe, data that the remote end still sends is dropped
+// and its writes fail with io.EOF. This end can still write.
+// Close must still be called to release the port.
+func (port *MessagePort) CloseRead() error {
+	return port.shutdown(ShutdownRead)
+}
+
+// shutdown closes one direction of the port and tells the remote end.
+func (port *MessagePort) shutdown(how Shutdown) error {
+	port.start()
+
+	flag := shutWrite
+	if how == ShutdownRead {
+		flag = shutRead
+	}
+
+	port.sendMu.Lock()
+	defer port.sendMu.Unlock()
+
+	port.mu.Lock()
+	switch {
+	case port.state == portEOF:
+		port.mu.Unlock()
+		return io.EOF
+	case port.state == portErrored:
+		err := port.err
+		port.mu.Unlock()
+		return err
+	case port.shut&flag != 0 || !port.shutLocked(flag):
+		port.mu.Unlock()
+		return io.ErrClosedPipe
 	}
-	return port.value
+	port.mu.Unlock()
+
+	if how == ShutdownRead {
+		port.recvReader.Close()
+	}
+	port.post(Message{Kind: MessageEOF, Shutdown: how})
+	return nil
 }
 
 func (port *MessagePort) notifyEOF() {
 	// Notify the remote side to emit an EOF from now on.
-	port.PostMessage(map[string]interface{}{
-		"EOF": true,
-	})
+	port.post(Message{Kind: MessageEOF})
 }
 
-func (port *MessagePort) notifyReady() {
-	port.PostMessage(map[string]interface{}{
-		"ready": true,
-	})
+// post sends a protocol message. Nobody waits for its result so errors are only logged.
+func (port *MessagePort) post(msg Message) {
+	if err := port.postMessage(msg); err != nil {
+		logger.Debug("wrpc: MessagePort: post failed", logger.F("kind", msg.Kind), logger.F("err", err))
+	}
 }
 
-// PostMessage sends a raw js message to remote end.
-func (port *MessagePort) PostMessage(args ...interface{}) {
-	port.value.Call("postMessage", args...)
+// postMessage records and sends msg.
+func (port *MessagePort) postMessage(msg Message) error {
+	record(newRecord(port, Sent, msg))
+	return port.t.Post(msg)
 }
 
 // RemoteReady returns a channel that is closed when the remote end starts listening.
 func (port *MessagePort) RemoteReady() <-chan struct{} {
+	port.start()
 	return port.remoteReady
 }
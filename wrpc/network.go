@@ -4,10 +4,12 @@ package wrpc
 
 import (
 	"context"
-	"syscall/js"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/joomcode/errorx"
+	"github.com/mgnsk/jsutil/logger"
 )
 
 // TODO chrome needs high timeout, too slow for wasm
@@ -15,80 +17,125 @@ import (
 const ackTimeout = 3 * time.Second
 
 var (
-	links   = 0
-	workers []*Worker
+	workersMu sync.Mutex
+	workers   []*Worker
 )
 
+// spawnMu serializes linking the spawned workers.
+var spawnMu sync.Mutex
+
+// linkCount numbers the links between workers.
+var linkCount int32
+
+// Workers returns the workers spawned by this thread.
+func Workers() []*Worker {
+	workersMu.Lock()
+	defer workersMu.Unlock()
+	return append([]*Worker(nil), workers...)
+}
+
 // SpawnWorker spawns and connects a new webworker.
-func SpawnWorker(ctx context.Context) *Worker {
-	newWorker, err := CreateWorkerFromSource(IndexJS)
+// Calls are scheduled to it until ctx is done or a call cannot be posted to it.
+func SpawnWorker(ctx context.Context) (*Worker, error) {
+	return SpawnWorkerWith(ctx, SpawnOptions{})
+}
+
+// SpawnWorkerWith is like SpawnWorker but with options.
+func SpawnWorkerWith(ctx context.Context, opts SpawnOptions) (*Worker, error) {
+	var newWorker *Worker
+	var err error
+	if IndexJS != nil {
+		if len(opts.Args) > 0 || len(opts.Env) > 0 {
+			return nil, errorx.IllegalArgument.New("spawn options Args and Env need a Bootstrap, IndexJS must be nil")
+		}
+		newWorker, err = createWorker(DefaultWorkerFactory, IndexJS, nil, opts)
+	} else {
+		newWorker, err = DefaultBootstrap.CreateWorker(DefaultWorkerFactory, opts)
+	}
 	if err != nil {
-		errorx.Panic(errorx.Decorate(err, "error creating worker"))
+		return nil, errorx.Decorate(err, "error creating worker")
 	}
 
-	linkDone := make(chan struct{})
+	// Link one spawned worker at a time so that it is linked
+	// with every worker spawned before it.
+	spawnMu.Lock()
+	defer spawnMu.Unlock()
+
+	existing := Workers()
+	linkDone := make(chan error, len(existing))
+	linkIDs := make([]int, len(existing))
 
 	// Add links between this and previous workers.
-	for _, w := range workers {
+	for i, w := range existing {
 		existingWorker := w
 
-		messageChannel := js.Global().Get("MessageChannel").New()
-
-		port1 := NewMessagePort(messageChannel.Get("port1"))
-		port2 := NewMessagePort(messageChannel.Get("port2"))
+		port1, port2 := Pipe()
 
 		// Connect the two workers by starting event listeners and schedulers
 		// on both sides so they can communicate.
-		newWorker.StartRemoteScheduler(port1)
-		existingWorker.StartRemoteScheduler(port2)
-
-		links++
+		linkIDs[i] = int(atomic.AddInt32(&linkCount, 1))
+		newWorker.startLink(port1, linkIDs[i])
+		existingWorker.startLink(port2, linkIDs[i])
 
 		go func() {
-			select {
-			case <-newWorker.ACK():
-			case <-time.After(ackTimeout):
-				panic("ack timeout")
+			// Take the acks of both ends even when one fails,
+			// so that a late ack does not complete the next link.
+			var err error
+			for _, w := range []*Worker{newWorker, existingWorker} {
+				select {
+				case ackErr := <-w.ACK():
+					if err == nil {
+						err = ackErr
+					}
+				case <-time.After(ackTimeout):
+					linkDone <- errorx.TimeoutElapsed.New("waited for link ack in %s", ackTimeout)
+					return
+				}
 			}
-			select {
-			case <-existingWorker.ACK():
-			case <-time.After(ackTimeout):
-				panic("ack timeout")
-			}
-			linkDone <- struct{}{}
+			linkDone <- err
 		}()
 	}
 
-	go func() {
-		// Start scheduling to new worker.
-		if err := GlobalScheduler.RunScheduler(ctx, newWorker.MessagePort()); err != nil {
-			panic(err)
+	// Wait for all the new links we created.
+	for range existing {
+		if err := <-linkDone; err != nil {
+			newWorker.Terminate()
+			// Stop the links and their schedulers on the existing workers.
+			for i, w := range existing {
+				w.closeLink(linkIDs[i])
+			}
+			return nil, errorx.Decorate(err, "error linking worker")
 		}
-	}()
+	}
 
+	workersMu.Lock()
 	workers = append(workers, newWorker)
+	// Run the broadcasts that wait for new workers.
+	broadcasts.join(newWorker)
+	workersMu.Unlock()
 
-	if len(workers) > 1 {
-		// Wait for all the new links we created.
-		combinations := cnr(len(workers), 2)
-		for i := 0; i < combinations-links; i++ {
-			<-linkDone
+	go func() {
+		// Start scheduling to new worker until ctx is done or a call cannot be posted.
+		err := GlobalScheduler.RunScheduler(ctx, newWorker.MessagePort())
+		if ctx.Err() == nil {
+			logger.Error("wrpc: scheduling to worker stopped", logger.F("worker", newWorker.ID()), logger.F("err", err))
+		} else {
+			logger.Debug("wrpc: scheduling to worker stopped", logger.F("worker", newWorker.ID()), logger.F("err", err))
 		}
-	}
+		removeWorker(newWorker)
+	}()
 
-	return newWorker
+	return newWorker, nil
 }
 
-func factorial(n int) int {
-	if n >= 1 {
-		return n * factorial(n-1)
+// removeWorker removes w from the workers that calls are scheduled to.
+func removeWorker(w *Worker) {
+	workersMu.Lock()
+	defer workersMu.Unlock()
+	for i, other := range workers {
+		if other == w {
+			workers = append(workers[:i], workers[i+1:]...)
+			return
+		}
 	}
-	return 1
-}
-
-// A formula for the number of possible combinations of r objects from a set of n objects.
-// C(n, r) = n! / (r!(n-r)!)
-func cnr(n int, r int) int {
-	cnr := factorial(n) / (factorial(r) * factorial(n-r))
-	return cnr
 }
@@ -0,0 +1,129 @@
+// +build js,wasm
+
+package wrpc
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"syscall/js"
+
+	"github.com/mgnsk/jsutil/logger"
+)
+
+// OutputSink receives the output forwarded from workers
+// spawned with SpawnOptions.ForwardOutput.
+type OutputSink interface {
+	// WriteOutput receives bytes that a worker wrote to stdout (fd 1) or stderr (fd 2).
+	// Writes are not split on line boundaries.
+	WriteOutput(workerID int, fd int, p []byte)
+	// Log receives a console call of a worker, for example from jsutil.ConsoleLog
+	// or a logger.Console.
+	Log(workerID int, entry logger.Entry)
+}
+
+// ConsoleSink writes the forwarded output to the console of the main thread.
+// Each line is prefixed with the worker ID.
+type ConsoleSink struct {
+	mu sync.Mutex
+	// lines buffers incomplete lines by worker and fd.
+	lines map[[2]int][]byte
+}
+
+// NewConsoleSink constructor.
+func NewConsoleSink() *ConsoleSink {
+	return &ConsoleSink{lines: map[[2]int][]byte{}}
+}
+
+// defaultSink is used when SpawnOptions.Sink is nil.
+var defaultSink = NewConsoleSink()
+
+func workerPrefix(workerID int) string {
+	return fmt.Sprintf("[worker %d] ", workerID)
+}
+
+// WriteOutput writes the complete lines of p to console.log for stdout and console.error for stderr.
+func (s *ConsoleSink) WriteOutput(workerID int, fd int, p []byte) {
+	s.mu.Lock()
+	key := [2]int{workerID, fd}
+	buf := append(s.lines[key], p...)
+	var lines [][]byte
+	for {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			break
+		}
+		lines = append(lines, buf[:i])
+		buf = buf[i+1:]
+	}
+	s.lines[key] = append([]byte(nil), buf...)
+	s.mu.Unlock()
+
+	method := "log"
+	if fd == 2 {
+		method = "error"
+	}
+	for _, line := range lines {
+		js.Global().Get("console").Call(method, workerPrefix(workerID)+string(line))
+	}
+}
+
+// Log writes the entry to the console method matching its level.
+func (s *ConsoleSink) Log(workerID int, entry logger.Entry) {
+	logger.NewConsole(logger.LevelDebug).Log(entry.Level, workerPrefix(workerID)+entry.Msg, entry.Fields...)
+}
+
+// forward returns a handler that passes the output messages of a worker to sink.
+func forward(workerID int, sink OutputSink) func(Message) {
+	if sink == nil {
+		sink = defaultSink
+	}
+	return func(msg Message) {
+		switch msg.Kind {
+		case MessageOutput:
+			sink.WriteOutput(workerID, msg.FD, msg.Data)
+		case MessageLog:
+			sink.Log(workerID, *msg.Entry)
+		}
+	}
+}
+
+// forwardOutputJS replaces the stdout and stderr writes of the fs shim
+// and the console methods with ones that post to port.
+// It runs in plain javascript since the Go runtime writes
+// to fs.writeSync directly and cannot be called back there.
+const forwardOutputJS = `
+const post = (fd, buf) => {
+	const data = buf.slice();
+	port.postMessage({ output: { fd: fd, data: data.buffer } }, [data.buffer]);
+};
+const fs = globalThis.fs;
+const writeSync = fs.writeSync;
+const write = fs.write;
+fs.writeSync = function (fd, buf) {
+	if (fd === 1 || fd === 2) {
+		post(fd, buf);
+		return buf.length;
+	}
+	return writeSync.apply(this, arguments);
+};
+fs.write = function (fd, buf, offset, length, position, callback) {
+	if (fd === 1 || fd === 2) {
+		post(fd, buf.subarray(offset, offset + length));
+		callback(null, length);
+		return;
+	}
+	return write.apply(this, arguments);
+};
+const levels = { debug: 0, log: 1, info: 1, warn: 2, error: 3 };
+for (const method of Object.keys(levels)) {
+	console[method] = (...args) => {
+		port.postMessage({ log: { level: levels[method], msg: args.map(String).join(" ") } });
+	};
+}
+`
+
+// forwardOutput forwards the stdout, stderr and console output of this worker to port.
+func forwardOutput(port js.Value) {
+	js.Global().Get("Function").New("port", forwardOutputJS).Invoke(port)
+}
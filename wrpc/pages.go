@@ -0,0 +1,150 @@
+package wrpc
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mgnsk/jsutil/logger"
+)
+
+// PageTimeout is how long a shared worker keeps the session of a page that sends nothing,
+// since a page that is killed or frozen does not always get to close its port.
+// Pages ping the shared worker three times in PageTimeout.
+var PageTimeout = 10 * time.Second
+
+// pages are the sessions of the pages connected to this shared worker.
+var pages = &pageSet{sessions: map[int]*pageSession{}}
+
+// pageSet is a set of page sessions.
+type pageSet struct {
+	mu       sync.Mutex
+	next     int
+	sessions map[int]*pageSession
+}
+
+// pageSession is the scheduler session of a page connected to a shared worker.
+// The scheduler of the page posts its calls to the session one at a time.
+// They run on the shared worker and are stopped when the page disconnects.
+type pageSession struct {
+	id   int
+	port *MessagePort
+	// seen is the time in Unix nanoseconds when the page last sent a message.
+	seen int64
+
+	mu    sync.Mutex
+	calls map[*Call]struct{}
+}
+
+// accept starts a session for the page on the other end of t.
+// The session ends when the page closes its port or sends nothing for PageTimeout.
+func (s *pageSet) accept(t Transport) *pageSession {
+	session := &pageSession{calls: map[*Call]struct{}{}}
+	session.touch()
+
+	s.mu.Lock()
+	s.next++
+	session.id = s.next
+	s.sessions[session.id] = session
+	s.mu.Unlock()
+
+	session.port = newPort(t)
+	session.port.session = session
+	session.port.start()
+	go session.watch(PageTimeout)
+
+	go func() {
+		<-session.port.ctx.Done()
+		session.end()
+
+		s.mu.Lock()
+		delete(s.sessions, session.id)
+		s.mu.Unlock()
+	}()
+
+	return session
+}
+
+// count returns the number of connected pages.
+func (s *pageSet) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sessions)
+}
+
+// touch records that the page sent a message.
+func (p *pageSession) touch() {
+	atomic.StoreInt64(&p.seen, time.Now().UnixNano())
+}
+
+// watch closes the port of the session when the page sends nothing for timeout.
+func (p *pageSession) watch(timeout time.Duration) {
+	ticker := time.NewTicker(timeout / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.port.ctx.Done():
+			return
+		case <-ticker.C:
+			seen := time.Unix(0, atomic.LoadInt64(&p.seen))
+			if time.Since(seen) > timeout {
+				logger.Warn("wrpc: page timed out", logger.F("session", p.id))
+				p.port.Close()
+				return
+			}
+		}
+	}
+}
+
+// ping pings the shared worker on the other end of port
+// until the port is closed, so that it keeps the session of this page.
+func ping(port *MessagePort, timeout time.Duration) {
+	ticker := time.NewTicker(timeout / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-port.ctx.Done():
+			return
+		case <-ticker.C:
+			port.post(Message{Kind: MessagePing})
+		}
+	}
+}
+
+// run runs a call of the page on this thread
+// and releases the scheduler of the page when it returns.
+func (p *pageSession) run(call Call) {
+	p.mu.Lock()
+	p.calls[&call] = struct{}{}
+	p.mu.Unlock()
+
+	atomic.AddUint64(&CallCount, 1)
+	go call.exec(func() {
+		atomic.AddUint64(&CallCount, ^uint64(0))
+
+		p.mu.Lock()
+		delete(p.calls, &call)
+		p.mu.Unlock()
+
+		if !call.pinned {
+			p.port.post(Message{Kind: MessageDone})
+		}
+	})
+}
+
+// end closes the ports of the running calls so that their reads and writes fail.
+func (p *pageSession) end() {
+	p.mu.Lock()
+	calls := make([]*Call, 0, len(p.calls))
+	for call := range p.calls {
+		calls = append(calls, call)
+	}
+	p.mu.Unlock()
+
+	for _, call := range calls {
+		call.Output.Close()
+		if call.Input != nil {
+			call.Input.Close()
+		}
+	}
+}
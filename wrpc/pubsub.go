@@ -0,0 +1,240 @@
+package wrpc
+
+import (
+	"sync"
+
+	"github.com/joomcode/errorx"
+)
+
+// Overflow specifies what happens when a subscriber's buffer is full.
+type Overflow int
+
+const (
+	// OverflowBlock makes Publish wait until the subscriber has room.
+	// A Publish on another thread waits for the ack of the link
+	// that this thread only posts once the message is queued.
+	OverflowBlock Overflow = iota
+	// OverflowDrop drops the message for the subscriber.
+	OverflowDrop
+	// OverflowDisconnect closes the subscription.
+	OverflowDisconnect
+)
+
+// ErrSlowSubscriber is the error of a subscription that was disconnected by OverflowDisconnect.
+var ErrSlowSubscriber = errorx.RejectedOperation.New("subscriber buffer full")
+
+// SubscribeOptions configures a subscription.
+type SubscribeOptions struct {
+	// Buffer is the number of messages queued for the subscriber.
+	// One more message may be waiting to be received from C.
+	Buffer int
+	// Overflow is the policy when the buffer is full.
+	Overflow Overflow
+}
+
+// Subscription receives the messages published to a topic.
+// Each subscription has its own buffer and goroutine,
+// so a slow subscriber does not hold back the others.
+type Subscription struct {
+	topic    string
+	overflow Overflow
+	// queue is the buffer of the subscription.
+	// Its goroutine moves the messages to c.
+	queue chan []byte
+	c     chan []byte
+	done  chan struct{}
+
+	mu     sync.Mutex
+	err    error
+	closed bool
+}
+
+// C returns the channel of messages. It is closed when the subscription is closed.
+func (s *Subscription) C() <-chan []byte {
+	return s.c
+}
+
+// Err returns the reason the subscription was closed, if any.
+func (s *Subscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Close unsubscribes from the topic.
+// The messages that were not received are dropped.
+func (s *Subscription) Close() {
+	s.close(nil)
+}
+
+func (s *Subscription) close(err error) {
+	topics.unsubscribe(s)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.err = err
+	close(s.done)
+}
+
+// run moves the queued messages to c until the subscription is closed.
+func (s *Subscription) run() {
+	defer close(s.c)
+	for {
+		select {
+		case msg := <-s.queue:
+			select {
+			case s.c <- msg:
+			case <-s.done:
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// send queues msg according to the overflow policy.
+// It reports whether the subscriber must be disconnected.
+func (s *Subscription) send(msg []byte) (disconnect bool) {
+	select {
+	case <-s.done:
+		return false
+	default:
+	}
+
+	select {
+	case s.queue <- msg:
+		return false
+	default:
+	}
+
+	switch s.overflow {
+	case OverflowDrop:
+		return false
+	case OverflowDisconnect:
+		return true
+	default:
+		select {
+		case s.queue <- msg:
+		case <-s.done:
+		}
+		return false
+	}
+}
+
+// Subscribe subscribes to a topic on this thread.
+// Messages published on any thread are received.
+func Subscribe(topic string, opts SubscribeOptions) *Subscription {
+	s := &Subscription{
+		topic:    topic,
+		overflow: opts.Overflow,
+		queue:    make(chan []byte, opts.Buffer),
+		c:        make(chan []byte),
+		done:     make(chan struct{}),
+	}
+	topics.subscribe(s)
+	go s.run()
+	return s
+}
+
+// Publish sends data to the subscribers of topic on every thread.
+// It reuses the existing links between threads.
+// It waits for the subscribers on every thread that block on overflow.
+func Publish(topic string, data []byte) error {
+	if data == nil {
+		data = []byte{}
+	}
+
+	ports := links.list()
+	errs := make([]error, len(ports))
+	var wg sync.WaitGroup
+	for i, port := range ports {
+		wg.Add(1)
+		go func(i int, port *MessagePort) {
+			defer wg.Done()
+			errs[i] = port.publish(topic, data)
+		}(i, port)
+	}
+
+	topics.deliver(topic, append([]byte(nil), data...))
+	wg.Wait()
+
+	var failed []error
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+	return errorx.DecorateMany("error publishing to topic "+topic, failed...)
+}
+
+// publish posts a topic message to the thread on the other end of the link
+// and waits for its ack. The other end acks once its subscribers have queued it.
+// Publishes are serialized so that each ack belongs to the last message.
+func (port *MessagePort) publish(topic string, data []byte) error {
+	port.publishMu.Lock()
+	defer port.publishMu.Unlock()
+
+	if err := port.postMessage(Message{Kind: MessageTopic, Topic: topic, Data: data}); err != nil {
+		return err
+	}
+	select {
+	case <-port.ack:
+		return nil
+	case <-port.ctx.Done():
+		return errorx.IllegalState.New("link closed")
+	}
+}
+
+var topics = &topicSet{topics: map[string]map[*Subscription]struct{}{}}
+
+// topicSet holds the subscriptions of the topics on this thread.
+type topicSet struct {
+	mu     sync.Mutex
+	topics map[string]map[*Subscription]struct{}
+}
+
+func (ts *topicSet) subscribe(s *Subscription) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	subs, ok := ts.topics[s.topic]
+	if !ok {
+		subs = map[*Subscription]struct{}{}
+		ts.topics[s.topic] = subs
+	}
+	subs[s] = struct{}{}
+}
+
+// unsubscribe removes s and the topic once it has no subscribers.
+func (ts *topicSet) unsubscribe(s *Subscription) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if subs, ok := ts.topics[s.topic]; ok {
+		delete(subs, s)
+		if len(subs) == 0 {
+			delete(ts.topics, s.topic)
+		}
+	}
+}
+
+// deliver queues msg for the local subscribers of topic.
+// It waits for the subscribers that block on overflow,
+// so it must not be called from js event handlers.
+func (ts *topicSet) deliver(topic string, msg []byte) {
+	ts.mu.Lock()
+	subs := make([]*Subscription, 0, len(ts.topics[topic]))
+	for s := range ts.topics[topic] {
+		subs = append(subs, s)
+	}
+	ts.mu.Unlock()
+
+	for _, s := range subs {
+		if s.send(msg) {
+			s.close(ErrSlowSubscriber)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package wrpc
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/joomcode/errorx"
+)
+
+// Direction tells whether a recorded message was sent or received.
+type Direction string
+
+const (
+	// Sent is a message posted by the port.
+	Sent Direction = "send"
+	// Received is a message delivered to the port.
+	Received Direction = "recv"
+)
+
+// Record is a message sent or received by a port during a recording.
+type Record struct {
+	Time time.Time `json:"time"`
+	// Port is the ID of the port in this thread.
+	Port uint64      `json:"port"`
+	Dir  Direction   `json:"dir"`
+	Kind MessageKind `json:"kind"`
+	// Data is the payload as it was in transit.
+	Data    []byte `json:"data,omitempty"`
+	Deflate bool   `json:"deflate,omitempty"`
+	Topic   string `json:"topic,omitempty"`
+	// Shutdown is the direction closed by MessageEOF.
+	Shutdown Shutdown `json:"shutdown,omitempty"`
+	// Call is the name of the remote call of MessageCall.
+	Call   string `json:"call,omitempty"`
+	Pinned bool   `json:"pinned,omitempty"`
+	// Input and Output are the IDs of the ports of a received call.
+	// Input is zero when the call has no input.
+	Input  uint64 `json:"input,omitempty"`
+	Output uint64 `json:"output,omitempty"`
+	// Err is the error of a message that could not be decoded.
+	Err string `json:"err,omitempty"`
+}
+
+var kindNames = []string{
+	MessageReady:   "ready",
+	MessageAck:     "ack",
+	MessageDone:    "done",
+	MessageEOF:     "eof",
+	MessageData:    "data",
+	MessageTopic:   "topic",
+	MessageCall:    "call",
+	MessageOutput:  "output",
+	MessageLog:     "log",
+	MessageHello:   "hello",
+	MessageService: "service",
+	MessageOpen:    "open",
+	MessagePing:    "ping",
+}
+
+func (k MessageKind) String() string {
+	if k >= 0 && int(k) < len(kindNames) {
+		return kindNames[k]
+	}
+	return "unknown"
+}
+
+// MarshalText encodes the kind by its name.
+func (k MessageKind) MarshalText() ([]byte, error) {
+	if k < 0 || int(k) >= len(kindNames) {
+		return nil, errorx.IllegalArgument.New("invalid message kind %d", int(k))
+	}
+	return []byte(kindNames[k]), nil
+}
+
+// UnmarshalText decodes a kind encoded by MarshalText.
+func (k *MessageKind) UnmarshalText(text []byte) error {
+	for i, name := range kindNames {
+		if name == string(text) {
+			*k = MessageKind(i)
+			return nil
+		}
+	}
+	return errorx.IllegalFormat.New("invalid message kind %q", text)
+}
+
+// portIDs numbers the ports of this thread.
+var portIDs uint64
+
+func nextPortID() uint64 {
+	return atomic.AddUint64(&portIDs, 1)
+}
+
+// recorder writes records as JSON lines.
+type recorder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	err error
+}
+
+var (
+	recordingMu sync.RWMutex
+	recording   *recorder
+)
+
+// StartRecording logs every message that the ports of this thread send and receive
+// to w as JSON lines until stop is called. Only one recording runs at a time.
+// stop returns the first error writing to w.
+func StartRecording(w io.Writer) (stop func() error, err error) {
+	recordingMu.Lock()
+	defer recordingMu.Unlock()
+	if recording != nil {
+		return nil, errorx.IllegalState.New("already recording")
+	}
+
+	r := &recorder{enc: json.NewEncoder(w)}
+	recording = r
+
+	return func() error {
+		recordingMu.Lock()
+		if recording == r {
+			recording = nil
+		}
+		recordingMu.Unlock()
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return r.err
+	}, nil
+}
+
+// record logs rec when recording.
+func record(rec Record) {
+	recordingMu.RLock()
+	r := recording
+	recordingMu.RUnlock()
+	if r == nil {
+		return
+	}
+
+	rec.Time = time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+	if err := r.enc.Encode(rec); err != nil {
+		r.err = errorx.Decorate(err, "error writing recording")
+	}
+}
+
+// newRecord returns the record of msg on port.
+func newRecord(port *MessagePort, dir Direction, msg Message) Record {
+	rec := Record{
+		Port:     port.id,
+		Dir:      dir,
+		Kind:     msg.Kind,
+		Data:     msg.Data,
+		Deflate:  msg.Deflate,
+		Topic:    msg.Topic,
+		Shutdown: msg.Shutdown,
+	}
+	if msg.Call != nil {
+		rec.Call = funcName(msg.Call.RemoteCall)
+		rec.Pinned = msg.Call.Pinned
+	}
+	if msg.Err != nil {
+		rec.Err = msg.Err.Error()
+	}
+	return rec
+}
+
+// ReadRecords reads a recording written by StartRecording.
+func ReadRecords(r io.Reader) ([]Record, error) {
+	var records []Record
+	dec := json.NewDecoder(r)
+	for {
+		var rec Record
+		if err := dec.Decode(&rec); err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return nil, errorx.IllegalFormat.Wrap(err, "invalid record %d", len(records)+1)
+		}
+		records = append(records, rec)
+	}
+}
+
+// Replay runs f with the input that the received call recorded in records read,
+// and returns what f wrote. The input is read with the same chunks it was received in,
+// so a replay is deterministic as long as f is.
+func Replay(records []Record, call Record, f RemoteCall) ([]byte, error) {
+	if call.Kind != MessageCall || call.Dir != Received || call.Output == 0 {
+		return nil, errorx.IllegalArgument.New("record of port %d is not a received call", call.Port)
+	}
+
+	out := &replayOutput{}
+	if call.Input == 0 {
+		f(nil, out)
+		return out.buf, nil
+	}
+
+	in := &replayInput{}
+	for _, rec := range records {
+		if rec.Port != call.Input || rec.Dir != Received {
+			continue
+		}
+		if rec.Kind == MessageEOF && rec.Shutdown != ShutdownRead {
+			break
+		}
+		if rec.Kind != MessageData || len(rec.Data) == 0 {
+			continue
+		}
+		data := rec.Data
+		if rec.Deflate {
+			var err error
+			if data, err = inflate(data); err != nil {
+				return nil, err
+			}
+		}
+		in.chunks = append(in.chunks, data)
+	}
+
+	f(in, out)
+	return out.buf, nil
+}
+
+// replayInput reads recorded writes one at a time.
+type replayInput struct {
+	chunks [][]byte
+}
+
+func (r *replayInput) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.chunks[0])
+	if n < len(r.chunks[0]) {
+		r.chunks[0] = r.chunks[0][n:]
+	} else {
+		r.chunks = r.chunks[1:]
+	}
+	return n, nil
+}
+
+// replayOutput collects the output of a replayed call.
+type replayOutput struct {
+	buf    []byte
+	closed bool
+}
+
+func (w *replayOutput) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, io.ErrClosedPipe
+	}
+	w.buf = append(w.buf, p...)
+	return len(p), nil
+}
+
+func (w *replayOutput) Close() error {
+	if w.closed {
+		return io.ErrClosedPipe
+	}
+	w.closed = true
+	return nil
+}
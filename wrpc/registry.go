@@ -0,0 +1,95 @@
+package wrpc
+
+import (
+	"runtime"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/joomcode/errorx"
+)
+
+// Register allows the functions to run as remote calls.
+// Workers only run registered calls. Since every thread runs the same binary,
+// register the functions on every thread, for example in an init function.
+func Register(calls ...RemoteCall) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	for _, f := range calls {
+		if f != nil {
+			registry.calls[callID(f)] = f
+		}
+	}
+}
+
+var registry = &callRegistry{calls: map[uintptr]RemoteCall{}}
+
+// callRegistry is the allowlist of remote calls.
+type callRegistry struct {
+	mu    sync.RWMutex
+	calls map[uintptr]RemoteCall
+}
+
+// lookupCall returns the registered call with id.
+func lookupCall(id uintptr) (RemoteCall, bool) {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	f, ok := registry.calls[id]
+	return f, ok
+}
+
+// checkRegistered returns an error if f may not be run remotely.
+func checkRegistered(f RemoteCall) error {
+	if f == nil {
+		return errorx.IllegalArgument.New("nil remote call")
+	}
+	if err := checkStatic(f); err != nil {
+		return err
+	}
+	if _, ok := lookupCall(callID(f)); !ok {
+		return errorx.IllegalArgument.New("remote call %s is not registered", funcName(f))
+	}
+	return nil
+}
+
+// checkStatic returns an error if f is a closure that captures state or a method value.
+// Their function values may hold state of the caller that does not exist on other threads.
+//
+// The function value of a top level function or of a function literal that captures nothing
+// is static data of the binary. The function value of a closure or a method value
+// holds the captured variables or the receiver, so it is allocated on the heap.
+// The name is only used to tell them apart in the error.
+func checkStatic(f RemoteCall) error {
+	if base, _, _ := findObject(callID(f), 0, 0); base == 0 {
+		return nil
+	}
+	name := funcName(f)
+	if strings.HasSuffix(name, "-fm") {
+		return errorx.IllegalArgument.New("remote call %s is a method value, declare it as a top level function", name)
+	}
+	return errorx.IllegalArgument.New("remote call %s is a closure that captures state, declare it as a top level function", name)
+}
+
+// findObject returns the base address of the heap object that contains p, or 0.
+//
+//go:linkname findObject runtime.findObject
+func findObject(p, refBase, refOff uintptr) (base uintptr, s unsafe.Pointer, objIndex uintptr)
+
+// callID returns the address of the function value of f.
+// It is the same on every thread for statically declared functions.
+func callID(f RemoteCall) uintptr {
+	return *(*uintptr)(unsafe.Pointer(&f))
+}
+
+// funcName returns the name of the function f points to.
+func funcName(f RemoteCall) string {
+	if f == nil {
+		return "<nil>"
+	}
+	// A function value points to a struct that starts with the code pointer.
+	pc := **(**uintptr)(unsafe.Pointer(&f))
+	if fn := runtime.FuncForPC(pc); fn != nil {
+		return fn.Name()
+	}
+	return "<unknown>"
+}
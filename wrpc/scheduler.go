@@ -1,16 +1,18 @@
-// +build js,wasm
-
 package wrpc
 
 import (
 	"context"
+	"sync/atomic"
 
-	"github.com/mgnsk/jsutil"
+	"github.com/joomcode/errorx"
+	"github.com/mgnsk/jsutil/logger"
 )
 
 // Scheduler schedules calls to ports.
 type Scheduler struct {
 	queue chan Call
+	// runners is the number of ports the scheduler runs on.
+	runners int32
 }
 
 // NewScheduler constructor.
@@ -23,15 +25,33 @@ func NewScheduler() *Scheduler {
 // RunScheduler starts a scheduler to schedule calls to port.
 // Runs sync on a single port.
 func (s *Scheduler) RunScheduler(ctx context.Context, port *MessagePort) error {
+	atomic.AddInt32(&s.runners, 1)
+	defer atomic.AddInt32(&s.runners, -1)
+
+	port.start()
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		case call := <-s.queue:
-			messages, transferables := call.getJS()
-			port.PostMessage(messages, transferables)
-			<-call.Output.ack
-			jsutil.Dump("Scheduler call done:", call)
+			port.mu.Lock()
+			port.pendingCalls++
+			port.mu.Unlock()
+			if err := port.postMessage(Message{Kind: MessageCall, Call: call.message()}); err != nil {
+				port.mu.Lock()
+				port.pendingCalls--
+				port.mu.Unlock()
+				// Do not leave the caller waiting for the output.
+				call.Output.Close()
+				return errorx.Decorate(err, "error posting call")
+			}
+			// Wait for the call to finish before scheduling the next one.
+			select {
+			case <-port.callDone:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			logger.Debug("wrpc: scheduler call done", logger.F("call", call))
 		}
 	}
 }
@@ -45,3 +65,8 @@ func (s *Scheduler) Call(ctx context.Context, call Call) error {
 	}
 	return nil
 }
+
+// runnerCount returns the number of ports the scheduler runs on.
+func (s *Scheduler) runnerCount() int {
+	return int(atomic.LoadInt32(&s.runners))
+}
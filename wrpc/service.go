@@ -0,0 +1,243 @@
+package wrpc
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/joomcode/errorx"
+	"github.com/mgnsk/jsutil/logger"
+)
+
+// ServiceHandler serves a stream opened to a service.
+// Each stream is served in its own goroutine.
+type ServiceHandler func(conn io.ReadWriteCloser)
+
+// RegisterService registers a long-lived service on this thread
+// and announces it to the linked threads. The handler can keep state
+// between streams, for example a loaded model or an open database.
+func RegisterService(name string, h ServiceHandler) error {
+	if h == nil {
+		return errorx.IllegalArgument.New("service %s: nil handler", name)
+	}
+	if err := services.register(name, h); err != nil {
+		return err
+	}
+	announce(name, true)
+	return nil
+}
+
+// UnregisterService removes a service from this thread.
+// Open streams are not closed.
+func UnregisterService(name string) {
+	if services.unregister(name) {
+		announce(name, false)
+	}
+}
+
+// OpenService opens a stream to a service by name.
+// A service on this thread is preferred, otherwise the worker with the lowest ID is used.
+// It waits until the service is announced or ctx is done.
+func OpenService(ctx context.Context, name string) (io.ReadWriteCloser, error) {
+	return openService(ctx, -1, name)
+}
+
+// OpenServiceOn opens a stream to a service on the worker with workerID.
+// The main thread has the ID 0.
+// It waits until the service is announced or ctx is done.
+func OpenServiceOn(ctx context.Context, workerID int, name string) (io.ReadWriteCloser, error) {
+	if workerID < 0 {
+		return nil, errorx.IllegalArgument.New("invalid worker ID %d", workerID)
+	}
+	return openService(ctx, workerID, name)
+}
+
+func openService(ctx context.Context, workerID int, name string) (io.ReadWriteCloser, error) {
+	for {
+		h, host, changed := services.lookup(name, workerID)
+
+		if h != nil {
+			local, remote := Pipe()
+			go h(remote)
+			return local, nil
+		}
+
+		if host >= 0 {
+			if port, ok := links.peer(host); ok {
+				local, remote := Pipe()
+				if err := port.postMessage(Message{
+					Kind:    MessageOpen,
+					Service: &ServiceMessage{Name: name, Conn: remote.t},
+				}); err != nil {
+					return nil, errorx.Decorate(err, "error opening service %s", name)
+				}
+				return local, nil
+			}
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, errorx.Decorate(ctx.Err(), "service %s not found", name)
+		}
+	}
+}
+
+// announce posts the state of a local service to every linked thread.
+func announce(name string, up bool) {
+	for _, port := range links.list() {
+		port.post(Message{
+			Kind:    MessageService,
+			ID:      localID,
+			Service: &ServiceMessage{Name: name, Up: up},
+		})
+	}
+}
+
+// greet handles the hello of a linked thread.
+// The local services are announced to it since it may have joined later.
+func greet(port *MessagePort, id int) {
+	links.identify(port, id)
+	for _, name := range services.localNames() {
+		port.post(Message{
+			Kind:    MessageService,
+			ID:      localID,
+			Service: &ServiceMessage{Name: name, Up: true},
+		})
+	}
+	services.notify()
+}
+
+// serveStream serves a stream opened to a local service.
+func serveStream(m *ServiceMessage) {
+	conn := NewPort(m.Conn)
+	h, ok := services.handler(m.Name)
+	if !ok {
+		logger.Warn("wrpc: stream to unknown service", logger.F("service", m.Name))
+		conn.Close()
+		return
+	}
+	go h(conn)
+}
+
+var services = &serviceSet{
+	local:   map[string]ServiceHandler{},
+	remote:  map[string]map[int]struct{}{},
+	changed: make(chan struct{}),
+}
+
+// serviceSet holds the local services and the services announced by linked threads.
+type serviceSet struct {
+	mu     sync.Mutex
+	local  map[string]ServiceHandler
+	remote map[string]map[int]struct{}
+	// changed is closed and replaced when the set changes.
+	changed chan struct{}
+}
+
+func (s *serviceSet) register(name string, h ServiceHandler) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.local[name]; ok {
+		return errorx.IllegalState.New("service %s is already registered", name)
+	}
+	s.local[name] = h
+	s.notifyLocked()
+	return nil
+}
+
+func (s *serviceSet) unregister(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.local[name]; !ok {
+		return false
+	}
+	delete(s.local, name)
+	s.notifyLocked()
+	return true
+}
+
+func (s *serviceSet) handler(name string) (ServiceHandler, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.local[name]
+	return h, ok
+}
+
+func (s *serviceSet) localNames() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.local))
+	for name := range s.local {
+		names = append(names, name)
+	}
+	return names
+}
+
+// update records an announcement of a linked thread.
+func (s *serviceSet) update(host int, m *ServiceMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hosts, ok := s.remote[m.Name]
+	if !ok {
+		hosts = map[int]struct{}{}
+		s.remote[m.Name] = hosts
+	}
+	if m.Up {
+		hosts[host] = struct{}{}
+	} else {
+		delete(hosts, host)
+	}
+	s.notifyLocked()
+}
+
+// dropHost forgets the services of a thread whose link was closed.
+func (s *serviceSet) dropHost(host int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, hosts := range s.remote {
+		delete(hosts, host)
+	}
+	s.notifyLocked()
+}
+
+// lookup returns the local handler or the ID of a host of the service.
+// The host is -1 if none is known. changed is closed when the set changes.
+func (s *serviceSet) lookup(name string, workerID int) (h ServiceHandler, host int, changed <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if workerID < 0 || workerID == localID {
+		if h, ok := s.local[name]; ok {
+			return h, -1, s.changed
+		}
+		if workerID == localID {
+			return nil, -1, s.changed
+		}
+	}
+
+	var ids []int
+	for id := range s.remote[name] {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		if workerID < 0 || id == workerID {
+			return nil, id, s.changed
+		}
+	}
+	return nil, -1, s.changed
+}
+
+func (s *serviceSet) notify() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.notifyLocked()
+}
+
+func (s *serviceSet) notifyLocked() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
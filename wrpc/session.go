@@ -0,0 +1,461 @@
+package wrpc
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"github.com/mgnsk/jsutil/logger"
+)
+
+// FrameConn is a message oriented connection, such as a WebSocket.
+type FrameConn interface {
+	// ReadFrame returns the next frame.
+	ReadFrame() ([]byte, error)
+	// WriteFrame sends a frame.
+	WriteFrame(frame []byte) error
+	Close() error
+}
+
+// Session runs calls by name between two processes over a FrameConn,
+// for example between a browser and a native Go server.
+// Function pointers differ between binaries, so calls are named.
+// Each call streams its input and output over the connection like a Pipe.
+type Session struct {
+	conn  FrameConn
+	calls map[string]RemoteCall
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	streams map[streamKey]*sessionStream
+	pending map[uint64]chan error
+	next    uint64
+	err     error
+	done    chan struct{}
+}
+
+// streamKey identifies a stream. Both ends allocate IDs,
+// so the key tells whether this end allocated it.
+type streamKey struct {
+	id    uint64
+	local bool
+}
+
+// Frame types of a session.
+const (
+	frameCall byte = iota + 1
+	frameResult
+	frameStream
+)
+
+// frameDeflate is set in the message kind of a stream frame
+// when the message has Deflate set.
+const frameDeflate byte = 0x80
+
+// NewSession starts a session over conn.
+// The other end may run the calls by their names. calls may be nil.
+func NewSession(conn FrameConn, calls map[string]RemoteCall) *Session {
+	s := &Session{
+		conn:    conn,
+		calls:   make(map[string]RemoteCall, len(calls)),
+		streams: map[streamKey]*sessionStream{},
+		pending: map[uint64]chan error{},
+		done:    make(chan struct{}),
+	}
+	for name, f := range calls {
+		s.calls[name] = f
+	}
+	go s.read()
+	return s
+}
+
+// Go runs the call name on the other end.
+// The returned Handle is done when the call has returned and the input and output are copied.
+func (s *Session) Go(in io.Reader, out io.WriteCloser, name string) *Handle {
+	h := newHandle()
+	defer h.seal()
+
+	if out == nil {
+		h.fail(errorx.IllegalArgument.New("must have output"))
+		return h
+	}
+
+	result := make(chan error, 1)
+
+	s.mu.Lock()
+	if s.err != nil {
+		err := s.err
+		s.mu.Unlock()
+		h.fail(errorx.Decorate(err, "session closed"))
+		return h
+	}
+	s.next++
+	outID := s.next
+	var inID uint64
+	if in != nil {
+		s.next++
+		inID = s.next
+	}
+	// Register the streams with the call so that
+	// a session that ends in between closes them too.
+	s.pending[outID] = result
+	outStream := s.streamLocked(streamKey{id: outID, local: true})
+	var inStream *sessionStream
+	if in != nil {
+		inStream = s.streamLocked(streamKey{id: inID, local: true})
+	}
+	s.mu.Unlock()
+
+	outPort := NewPort(outStream)
+	var inPort *MessagePort
+	if inStream != nil {
+		inPort = newPort(inStream)
+	}
+
+	frame := []byte{frameCall}
+	frame = appendUvarint(frame, outID)
+	frame = appendUvarint(frame, inID)
+	frame = append(frame, name...)
+	if err := s.write(frame); err != nil {
+		s.finish(outID, err)
+	}
+
+	if inPort != nil {
+		inPort.start()
+		h.run(func() error {
+			defer inPort.Close()
+
+			select {
+			case <-inPort.RemoteReady():
+			case <-time.After(readyTimeout):
+				return errorx.TimeoutElapsed.New("waited for input port ready in %s", readyTimeout)
+			case <-s.done:
+				return errorx.Decorate(s.Err(), "session closed")
+			}
+
+			if _, err := io.Copy(inPort, in); err != nil {
+				return errorx.Decorate(err, "error copying input")
+			}
+			return nil
+		})
+	}
+
+	h.run(func() error {
+		defer out.Close()
+		if _, err := io.Copy(out, outPort); err != nil {
+			return errorx.Decorate(err, "error copying output")
+		}
+		return nil
+	})
+
+	h.run(func() error {
+		return <-result
+	})
+
+	return h
+}
+
+// Done returns a channel that is closed when the session has ended.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns the reason the session ended, or nil.
+func (s *Session) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Close closes the connection. The open streams get EOF and pending calls fail.
+func (s *Session) Close() error {
+	return s.conn.Close()
+}
+
+func (s *Session) read() {
+	for {
+		frame, err := s.conn.ReadFrame()
+		if err != nil {
+			s.end(err)
+			return
+		}
+		if err := s.handle(frame); err != nil {
+			logger.Error("wrpc: Session: invalid frame", logger.F("err", err))
+		}
+	}
+}
+
+// end fails everything in flight with err.
+func (s *Session) end(err error) {
+	s.mu.Lock()
+	s.err = err
+	streams := s.streams
+	pending := s.pending
+	s.streams = map[streamKey]*sessionStream{}
+	s.pending = map[uint64]chan error{}
+	s.mu.Unlock()
+
+	for _, st := range streams {
+		st.deliver(Message{Kind: MessageEOF})
+	}
+	for _, result := range pending {
+		result <- errorx.Decorate(err, "session closed")
+	}
+	close(s.done)
+}
+
+func (s *Session) handle(frame []byte) error {
+	if len(frame) == 0 {
+		return errorx.IllegalFormat.New("empty frame")
+	}
+	kind, frame := frame[0], frame[1:]
+
+	switch kind {
+	case frameCall:
+		outID, n := binary.Uvarint(frame)
+		if n <= 0 || outID == 0 {
+			return errorx.IllegalFormat.New("invalid call output")
+		}
+		frame = frame[n:]
+		inID, n := binary.Uvarint(frame)
+		if n <= 0 {
+			return errorx.IllegalFormat.New("invalid call input")
+		}
+		s.serve(string(frame[n:]), outID, inID)
+
+	case frameResult:
+		id, n := binary.Uvarint(frame)
+		if n <= 0 {
+			return errorx.IllegalFormat.New("invalid result")
+		}
+		var err error
+		if msg := frame[n:]; len(msg) > 0 {
+			err = errorx.ExternalError.New("%s", msg)
+		}
+		s.finish(id, err)
+
+	case frameStream:
+		if len(frame) < 1 {
+			return errorx.IllegalFormat.New("invalid stream frame")
+		}
+		// The sender tells whether it allocated the stream.
+		local := frame[0] == 0
+		id, n := binary.Uvarint(frame[1:])
+		if n <= 0 || len(frame) < 1+n+1 {
+			return errorx.IllegalFormat.New("invalid stream frame")
+		}
+		kind := frame[1+n]
+		msg := Message{
+			Kind:    MessageKind(kind &^ frameDeflate),
+			Data:    frame[1+n+1:],
+			Deflate: kind&frameDeflate != 0,
+		}
+		if !isStreamKind(msg.Kind) {
+			return errorx.IllegalFormat.New("invalid stream message kind %d", msg.Kind)
+		}
+		if msg.Kind == MessageEOF {
+			// The data of an EOF is the closed direction.
+			if len(msg.Data) == 1 {
+				switch how := Shutdown(msg.Data[0]); how {
+				case ShutdownWrite, ShutdownRead:
+					msg.Shutdown = how
+				}
+			}
+			msg.Data = nil
+		}
+
+		s.mu.Lock()
+		st, ok := s.streams[streamKey{id: id, local: local}]
+		s.mu.Unlock()
+		if ok {
+			st.deliver(msg)
+		}
+
+	default:
+		return errorx.IllegalFormat.New("unknown frame type %d", kind)
+	}
+
+	return nil
+}
+
+// serve runs the call name for the other end.
+func (s *Session) serve(name string, outID, inID uint64) {
+	out := NewPort(s.stream(streamKey{id: outID}))
+	var in *MessagePort
+	if inID != 0 {
+		in = NewPort(s.stream(streamKey{id: inID}))
+	}
+
+	f, ok := s.calls[name]
+	if !ok {
+		out.Close()
+		if in != nil {
+			in.Close()
+		}
+		s.result(outID, errorx.IllegalArgument.New("unknown call %s", name))
+		return
+	}
+
+	go func() {
+		var err error
+		defer func() {
+			if r := recover(); r != nil {
+				err = errorx.InternalError.New("call %s panicked: %v", name, r)
+				out.Close()
+			}
+			s.result(outID, err)
+		}()
+
+		if in == nil {
+			// Do not pass a typed nil.
+			f(nil, out)
+		} else {
+			f(in, out)
+		}
+	}()
+}
+
+// result posts the result of the call with output outID.
+func (s *Session) result(outID uint64, err error) {
+	frame := appendUvarint([]byte{frameResult}, outID)
+	if err != nil {
+		frame = append(frame, err.Error()...)
+	}
+	if err := s.write(frame); err != nil {
+		logger.Debug("wrpc: Session: error posting result", logger.F("err", err))
+	}
+}
+
+// finish delivers the result of a call made by this end.
+func (s *Session) finish(outID uint64, err error) {
+	s.mu.Lock()
+	result, ok := s.pending[outID]
+	delete(s.pending, outID)
+	s.mu.Unlock()
+
+	if ok {
+		result <- err
+	}
+}
+
+func (s *Session) write(frame []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.conn.WriteFrame(frame)
+}
+
+// stream creates the transport of the stream key.
+func (s *Session) stream(key streamKey) *sessionStream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streamLocked(key)
+}
+
+// streamLocked creates the transport of the stream key. The stream of
+// an ended session gets EOF right away. s.mu must be held.
+func (s *Session) streamLocked(key streamKey) *sessionStream {
+	st := &sessionStream{session: s, key: key}
+	if s.err == nil {
+		s.streams[key] = st
+	} else {
+		st.queue = []Message{{Kind: MessageEOF}}
+	}
+	return st
+}
+
+// sessionStream is a Transport for one stream of a session.
+// Messages are queued until it listens.
+type sessionStream struct {
+	streamInbox
+	session *Session
+	key     streamKey
+}
+
+// Post sends msg to the stream on the other end.
+func (st *sessionStream) Post(msg Message) error {
+	if !isStreamKind(msg.Kind) {
+		return errorx.IllegalArgument.New("cannot send message kind %d over a session", msg.Kind)
+	}
+
+	// Tell the other end whether this end allocated the stream.
+	owner := byte(0)
+	if st.key.local {
+		owner = 1
+	}
+	frame := []byte{frameStream, owner}
+	frame = appendUvarint(frame, st.key.id)
+	kind := byte(msg.Kind)
+	if msg.Deflate {
+		kind |= frameDeflate
+	}
+	frame = append(frame, kind)
+	if msg.Kind == MessageEOF && msg.Shutdown != ShutdownBoth {
+		frame = append(frame, byte(msg.Shutdown))
+	}
+	frame = append(frame, msg.Data...)
+	return st.session.write(frame)
+}
+
+// carriesDeflate is true since the frames carry the flag in the message kind.
+func (st *sessionStream) carriesDeflate() bool {
+	return true
+}
+
+// Close stops receiving messages of the stream.
+func (st *sessionStream) Close() {
+	s := st.session
+	s.mu.Lock()
+	if s.streams[st.key] == st {
+		delete(s.streams, st.key)
+	}
+	s.mu.Unlock()
+}
+
+// streamInbox delivers the messages received for a stream that is multiplexed
+// over a connection. Messages are queued until it listens.
+type streamInbox struct {
+	// mu is held while messages are delivered,
+	// so that the queued messages are delivered before the later ones.
+	mu      sync.Mutex
+	handler func(Message)
+	queue   []Message
+}
+
+// Listen delivers the queued and future messages to handler.
+func (in *streamInbox) Listen(handler func(Message)) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.handler = handler
+	for _, msg := range in.queue {
+		handler(msg)
+	}
+	in.queue = nil
+}
+
+func (in *streamInbox) deliver(msg Message) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.handler == nil {
+		in.queue = append(in.queue, msg)
+		return
+	}
+	in.handler(msg)
+}
+
+// isStreamKind reports whether kind is carried by a stream
+// that is multiplexed over a connection, such as a session or a tab group.
+func isStreamKind(kind MessageKind) bool {
+	switch kind {
+	case MessageReady, MessageAck, MessageEOF, MessageData:
+		return true
+	}
+	return false
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
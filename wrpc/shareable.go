@@ -0,0 +1,15 @@
+// +build !js !wasm
+
+package wrpc
+
+import "io"
+
+// Shareable is a value that can be passed to a remote call by reference.
+// Without js, calls run in this process so any value can be shared.
+type Shareable interface{}
+
+// SharedValue returns the shared value passed with CallOptions
+// to the call that has out as output.
+func SharedValue(out io.Writer, name string) (interface{}, bool) {
+	return sharedValue(out, name)
+}
@@ -0,0 +1,397 @@
+// +build js,wasm
+
+package wrpc
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"syscall/js"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"github.com/mgnsk/jsutil"
+)
+
+// The primitives in this file synchronize goroutines on different workers
+// through a SharedArrayBuffer. Browsers only provide SharedArrayBuffer
+// on cross-origin isolated pages.
+//
+// Atomics.wait would block the whole js thread and with it every goroutine,
+// so a waiting goroutine parks on Atomics.waitAsync instead. Where that is not
+// available, it waits for a message on a BroadcastChannel named after the primitive.
+
+// sharedPollInterval bounds how long a message based waiter sleeps
+// before it checks the shared state again.
+const sharedPollInterval = 50 * time.Millisecond
+
+const (
+	// stateCell holds the state of the primitive.
+	stateCell = 0
+	// waitersCell counts the message based waiters.
+	waitersCell = 1
+	cellCount   = 2
+)
+
+// Shareable is a value that can be passed to a remote call by reference.
+type Shareable interface {
+	JSValue() js.Value
+}
+
+// SharedValue returns the shared value passed with CallOptions
+// to the call that has out as output. The value can be opened
+// with the FromJS function of its type, for example MutexFromJS.
+func SharedValue(out io.Writer, name string) (js.Value, bool) {
+	v, ok := sharedValue(out, name)
+	if !ok {
+		return js.Undefined(), false
+	}
+	switch v := v.(type) {
+	case js.Value:
+		return v, true
+	case Shareable:
+		return v.JSValue(), true
+	}
+	return js.Undefined(), false
+}
+
+// sharedCells is an Int32Array over a SharedArrayBuffer.
+type sharedCells struct {
+	id  string
+	arr js.Value
+}
+
+func newSharedCells() (sharedCells, error) {
+	sab := js.Global().Get("SharedArrayBuffer")
+	if sab.Type() != js.TypeFunction {
+		return sharedCells{}, errorx.UnsupportedOperation.New("SharedArrayBuffer is not available")
+	}
+	return sharedCells{
+		id:  fmt.Sprintf("wrpc-shared-%d-%d", time.Now().UnixNano(), rand.Int63()),
+		arr: js.Global().Get("Int32Array").New(sab.New(cellCount * 4)),
+	}, nil
+}
+
+func sharedCellsFromJS(value js.Value) (sharedCells, error) {
+	if value.Type() != js.TypeObject || value.Get("id").Type() != js.TypeString {
+		return sharedCells{}, errorx.IllegalArgument.New("not a shared value")
+	}
+	buf := value.Get("buffer")
+	if !buf.InstanceOf(js.Global().Get("SharedArrayBuffer")) {
+		return sharedCells{}, errorx.IllegalArgument.New("not a shared value")
+	}
+	return sharedCells{
+		id:  value.Get("id").String(),
+		arr: js.Global().Get("Int32Array").New(buf),
+	}, nil
+}
+
+// JSValue returns the js object that can be posted to other workers.
+func (c sharedCells) JSValue() js.Value {
+	return js.ValueOf(map[string]interface{}{
+		"id":     c.id,
+		"buffer": c.arr.Get("buffer"),
+	})
+}
+
+func atomics() js.Value {
+	return js.Global().Get("Atomics")
+}
+
+func (c sharedCells) load(i int) int32 {
+	return int32(atomics().Call("load", c.arr, i).Int())
+}
+
+func (c sharedCells) store(i int, v int32) {
+	atomics().Call("store", c.arr, i, v)
+}
+
+// add adds v and returns the previous value.
+func (c sharedCells) add(i int, v int32) int32 {
+	return int32(atomics().Call("add", c.arr, i, v).Int())
+}
+
+// exchange stores v and returns the previous value.
+func (c sharedCells) exchange(i int, v int32) int32 {
+	return int32(atomics().Call("exchange", c.arr, i, v).Int())
+}
+
+// compareExchange stores v if the cell holds old and returns the previous value.
+func (c sharedCells) compareExchange(i int, old, v int32) int32 {
+	return int32(atomics().Call("compareExchange", c.arr, i, old, v).Int())
+}
+
+// notify wakes up to count waiters of the cell. A negative count wakes all.
+func (c sharedCells) notify(i int, count int) {
+	if count < 0 {
+		atomics().Call("notify", c.arr, i)
+	} else {
+		atomics().Call("notify", c.arr, i, count)
+	}
+
+	// Threads without BroadcastChannel poll instead.
+	if broadcast := js.Global().Get("BroadcastChannel"); broadcast.Type() == js.TypeFunction && c.load(waitersCell) > 0 {
+		bc := broadcast.New(c.id)
+		bc.Call("postMessage", i)
+		bc.Call("close")
+	}
+}
+
+// wait blocks the calling goroutine until the cell may no longer hold value.
+// Spurious wakeups are possible.
+func (c sharedCells) wait(i int, value int32) {
+	if waitAsync := atomics().Get("waitAsync"); waitAsync.Type() == js.TypeFunction {
+		res := atomics().Call("waitAsync", c.arr, i, value)
+		if res.Get("async").Bool() {
+			jsutil.Await(res.Get("value"))
+		}
+		return
+	}
+
+	if js.Global().Get("BroadcastChannel").Type() != js.TypeFunction {
+		time.Sleep(sharedPollInterval)
+		return
+	}
+
+	woke := make(chan struct{}, 1)
+	onmessage := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		select {
+		case woke <- struct{}{}:
+		default:
+		}
+		return nil
+	})
+	bc := js.Global().Get("BroadcastChannel").New(c.id)
+	bc.Set("onmessage", onmessage)
+	c.add(waitersCell, 1)
+
+	defer func() {
+		c.add(waitersCell, -1)
+		bc.Call("close")
+		onmessage.Release()
+	}()
+
+	// The value may have changed before we started listening.
+	if c.load(i) != value {
+		return
+	}
+
+	select {
+	case <-woke:
+	case <-time.After(sharedPollInterval):
+	}
+}
+
+// Mutex is a mutual exclusion lock shared between workers.
+type Mutex struct {
+	cells sharedCells
+}
+
+// NewMutex creates an unlocked mutex.
+func NewMutex() (*Mutex, error) {
+	cells, err := newSharedCells()
+	if err != nil {
+		return nil, err
+	}
+	return &Mutex{cells: cells}, nil
+}
+
+// MutexFromJS opens a mutex passed from another worker.
+func MutexFromJS(value js.Value) (*Mutex, error) {
+	cells, err := sharedCellsFromJS(value)
+	if err != nil {
+		return nil, err
+	}
+	return &Mutex{cells: cells}, nil
+}
+
+// JSValue returns the js value of the mutex.
+func (m *Mutex) JSValue() js.Value {
+	return m.cells.JSValue()
+}
+
+// Lock locks m. The state is 0 when unlocked, 1 when locked
+// and 2 when locked with possible waiters.
+func (m *Mutex) Lock() {
+	c := m.cells.compareExchange(stateCell, 0, 1)
+	if c == 0 {
+		return
+	}
+	if c != 2 {
+		c = m.cells.exchange(stateCell, 2)
+	}
+	for c != 0 {
+		m.cells.wait(stateCell, 2)
+		c = m.cells.exchange(stateCell, 2)
+	}
+}
+
+// TryLock tries to lock m and reports whether it succeeded.
+func (m *Mutex) TryLock() bool {
+	return m.cells.compareExchange(stateCell, 0, 1) == 0
+}
+
+// Unlock unlocks m.
+func (m *Mutex) Unlock() {
+	if m.cells.add(stateCell, -1) != 1 {
+		m.cells.store(stateCell, 0)
+		m.cells.notify(stateCell, 1)
+	}
+}
+
+// Semaphore is a counting semaphore shared between workers.
+type Semaphore struct {
+	cells sharedCells
+}
+
+// NewSemaphore creates a semaphore with n permits.
+func NewSemaphore(n int) (*Semaphore, error) {
+	cells, err := newSharedCells()
+	if err != nil {
+		return nil, err
+	}
+	cells.store(stateCell, int32(n))
+	return &Semaphore{cells: cells}, nil
+}
+
+// SemaphoreFromJS opens a semaphore passed from another worker.
+func SemaphoreFromJS(value js.Value) (*Semaphore, error) {
+	cells, err := sharedCellsFromJS(value)
+	if err != nil {
+		return nil, err
+	}
+	return &Semaphore{cells: cells}, nil
+}
+
+// JSValue returns the js value of the semaphore.
+func (s *Semaphore) JSValue() js.Value {
+	return s.cells.JSValue()
+}
+
+// Acquire takes a permit, waiting until one is available.
+func (s *Semaphore) Acquire() {
+	for {
+		v := s.cells.load(stateCell)
+		if v == 0 {
+			s.cells.wait(stateCell, 0)
+			continue
+		}
+		if s.cells.compareExchange(stateCell, v, v-1) == v {
+			return
+		}
+	}
+}
+
+// Release returns a permit.
+func (s *Semaphore) Release() {
+	s.cells.add(stateCell, 1)
+	s.cells.notify(stateCell, 1)
+}
+
+// WaitGroup waits for a collection of goroutines on any worker to finish.
+type WaitGroup struct {
+	cells sharedCells
+}
+
+// NewWaitGroup constructor.
+func NewWaitGroup() (*WaitGroup, error) {
+	cells, err := newSharedCells()
+	if err != nil {
+		return nil, err
+	}
+	return &WaitGroup{cells: cells}, nil
+}
+
+// WaitGroupFromJS opens a wait group passed from another worker.
+func WaitGroupFromJS(value js.Value) (*WaitGroup, error) {
+	cells, err := sharedCellsFromJS(value)
+	if err != nil {
+		return nil, err
+	}
+	return &WaitGroup{cells: cells}, nil
+}
+
+// JSValue returns the js value of the wait group.
+func (wg *WaitGroup) JSValue() js.Value {
+	return wg.cells.JSValue()
+}
+
+// Add adds delta to the counter. Like sync.WaitGroup, it panics if the counter goes negative.
+func (wg *WaitGroup) Add(delta int) {
+	v := wg.cells.add(stateCell, int32(delta)) + int32(delta)
+	if v < 0 {
+		panic("wrpc: negative WaitGroup counter")
+	}
+	if v == 0 {
+		wg.cells.notify(stateCell, -1)
+	}
+}
+
+// Done decrements the counter by one.
+func (wg *WaitGroup) Done() {
+	wg.Add(-1)
+}
+
+// Wait blocks until the counter is zero.
+func (wg *WaitGroup) Wait() {
+	for {
+		v := wg.cells.load(stateCell)
+		if v == 0 {
+			return
+		}
+		wg.cells.wait(stateCell, v)
+	}
+}
+
+// Once runs a function exactly once across workers.
+type Once struct {
+	cells sharedCells
+}
+
+const (
+	onceIdle = iota
+	onceRunning
+	onceDone
+)
+
+// NewOnce constructor.
+func NewOnce() (*Once, error) {
+	cells, err := newSharedCells()
+	if err != nil {
+		return nil, err
+	}
+	return &Once{cells: cells}, nil
+}
+
+// OnceFromJS opens a Once passed from another worker.
+func OnceFromJS(value js.Value) (*Once, error) {
+	cells, err := sharedCellsFromJS(value)
+	if err != nil {
+		return nil, err
+	}
+	return &Once{cells: cells}, nil
+}
+
+// JSValue returns the js value of the Once.
+func (o *Once) JSValue() js.Value {
+	return o.cells.JSValue()
+}
+
+// Do calls f if no call of Do on any worker has called it before.
+// Like sync.Once, no call returns before f has returned.
+func (o *Once) Do(f func()) {
+	if o.cells.load(stateCell) == onceDone {
+		return
+	}
+	if o.cells.compareExchange(stateCell, onceIdle, onceRunning) == onceIdle {
+		defer func() {
+			o.cells.store(stateCell, onceDone)
+			o.cells.notify(stateCell, -1)
+		}()
+		f()
+		return
+	}
+	for o.cells.load(stateCell) != onceDone {
+		o.cells.wait(stateCell, onceRunning)
+	}
+}
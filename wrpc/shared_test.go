@@ -0,0 +1,329 @@
+// +build js,wasm
+
+package wrpc_test
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"syscall/js"
+	"time"
+
+	"github.com/mgnsk/jsutil/wrpc"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func init() {
+	wrpc.Register(lockCells, tryLock, acquireCells, doOnce)
+}
+
+// Cells of the shared counters.
+const (
+	// activeCell counts the goroutines in a critical section.
+	activeCell = iota
+	// maxCell is the highest number of goroutines seen in a critical section.
+	maxCell
+	// totalCell counts the critical sections that were run.
+	totalCell
+	// overlapCell counts the critical sections that overlapped with another.
+	overlapCell
+	counterCount
+)
+
+// counters are int32 counters in a SharedArrayBuffer.
+type counters struct {
+	arr js.Value
+}
+
+func newCounters() counters {
+	sab := js.Global().Get("SharedArrayBuffer").New(counterCount * 4)
+	return counters{arr: js.Global().Get("Int32Array").New(sab)}
+}
+
+func (c counters) JSValue() js.Value {
+	return c.arr
+}
+
+func (c counters) add(i int, v int32) int32 {
+	return int32(js.Global().Get("Atomics").Call("add", c.arr, i, v).Int()) + v
+}
+
+func (c counters) load(i int) int32 {
+	return int32(js.Global().Get("Atomics").Call("load", c.arr, i).Int())
+}
+
+// enter counts a goroutine entering a critical section.
+func (c counters) enter() {
+	n := c.add(activeCell, 1)
+	if n > 1 {
+		c.add(overlapCell, 1)
+	}
+	for {
+		max := c.load(maxCell)
+		if n <= max || int32(js.Global().Get("Atomics").Call("compareExchange", c.arr, maxCell, max, n).Int()) == max {
+			break
+		}
+	}
+	time.Sleep(time.Millisecond)
+}
+
+// leave counts a goroutine leaving a critical section.
+func (c counters) leave() {
+	c.add(activeCell, -1)
+	c.add(totalCell, 1)
+}
+
+// sharedCounters returns the counters passed to the call with output out.
+func sharedCounters(out io.Writer) counters {
+	v, _ := wrpc.SharedValue(out, "counters")
+	return counters{arr: v}
+}
+
+// contend runs f in goroutines goroutines n times each.
+func contend(goroutines, n int, f func()) {
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				f()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func lockCells(in io.Reader, out io.WriteCloser) {
+	defer out.Close()
+	v, _ := wrpc.SharedValue(out, "mu")
+	mu, err := wrpc.MutexFromJS(v)
+	if err != nil {
+		fmt.Fprint(out, err)
+		return
+	}
+	c := sharedCounters(out)
+	contend(4, 10, func() {
+		mu.Lock()
+		c.enter()
+		c.leave()
+		mu.Unlock()
+	})
+}
+
+func tryLock(in io.Reader, out io.WriteCloser) {
+	defer out.Close()
+	v, _ := wrpc.SharedValue(out, "mu")
+	mu, err := wrpc.MutexFromJS(v)
+	if err != nil {
+		fmt.Fprint(out, err)
+		return
+	}
+	if mu.TryLock() {
+		mu.Unlock()
+		fmt.Fprint(out, "locked")
+	} else {
+		fmt.Fprint(out, "busy")
+	}
+}
+
+func acquireCells(in io.Reader, out io.WriteCloser) {
+	defer out.Close()
+	v, _ := wrpc.SharedValue(out, "sem")
+	sem, err := wrpc.SemaphoreFromJS(v)
+	if err != nil {
+		fmt.Fprint(out, err)
+		return
+	}
+	c := sharedCounters(out)
+	contend(3, 5, func() {
+		sem.Acquire()
+		c.enter()
+		c.leave()
+		sem.Release()
+	})
+}
+
+func doOnce(in io.Reader, out io.WriteCloser) {
+	defer out.Close()
+	v, _ := wrpc.SharedValue(out, "once")
+	once, err := wrpc.OnceFromJS(v)
+	if err != nil {
+		fmt.Fprint(out, err)
+		return
+	}
+	c := sharedCounters(out)
+	contend(3, 2, func() {
+		once.Do(func() {
+			c.enter()
+			time.Sleep(20 * time.Millisecond)
+			c.leave()
+		})
+		// No call returns before f has returned.
+		if c.load(totalCell) != 1 {
+			c.add(overlapCell, 1)
+		}
+	})
+}
+
+// withoutGlobals removes the js globals on this thread until restore is called,
+// so that the primitives fall back to the waits that do not need them.
+func withoutGlobals(obj js.Value, names ...string) (restore func()) {
+	prev := make([]js.Value, len(names))
+	for i, name := range names {
+		prev[i] = obj.Get(name)
+		obj.Set(name, js.Undefined())
+	}
+	return func() {
+		for i, name := range names {
+			obj.Set(name, prev[i])
+		}
+	}
+}
+
+// goOnWorkers runs f on every worker with the shared values.
+func goOnWorkers(f wrpc.RemoteCall, shared map[string]wrpc.Shareable) []*wrpc.Handle {
+	var handles []*wrpc.Handle
+	for i := 0; i < workerCount; i++ {
+		handles = append(handles, wrpc.GoWith(nil, &buffer{}, f, wrpc.CallOptions{Shared: shared}))
+	}
+	return handles
+}
+
+var _ = Describe("Shared primitives", func() {
+	// fallbacks are the ways the main thread waits while the workers use Atomics.waitAsync.
+	// The globals are removed on the main thread to make it fall back.
+	fallbacks := []struct {
+		name    string
+		globals []string
+	}{
+		{"Atomics.waitAsync", nil},
+		{"BroadcastChannel", []string{"waitAsync"}},
+		{"polling", []string{"waitAsync", "BroadcastChannel"}},
+	}
+
+	removeGlobals := func(names []string) (restore func()) {
+		var restores []func()
+		for _, name := range names {
+			if name == "waitAsync" {
+				restores = append(restores, withoutGlobals(js.Global().Get("Atomics"), name))
+			} else {
+				restores = append(restores, withoutGlobals(js.Global(), name))
+			}
+		}
+		return func() {
+			for _, restore := range restores {
+				restore()
+			}
+		}
+	}
+
+	for _, fallback := range fallbacks {
+		fallback := fallback
+
+		Context("when this thread waits with "+fallback.name, func() {
+			var restore func()
+
+			BeforeEach(func() {
+				restore = removeGlobals(fallback.globals)
+			})
+
+			AfterEach(func() {
+				restore()
+			})
+
+			It("locks a Mutex contended across workers", func() {
+				mu, err := wrpc.NewMutex()
+				Expect(err).To(BeNil())
+				c := newCounters()
+
+				handles := goOnWorkers(lockCells, map[string]wrpc.Shareable{"mu": mu, "counters": c})
+				contend(2, 10, func() {
+					mu.Lock()
+					c.enter()
+					c.leave()
+					mu.Unlock()
+				})
+				for _, h := range handles {
+					Expect(wait(h)).To(Succeed())
+				}
+
+				Expect(c.load(totalCell)).To(Equal(int32(workerCount*4*10 + 2*10)))
+				Expect(c.load(overlapCell)).To(BeZero())
+				Expect(c.load(maxCell)).To(Equal(int32(1)))
+			})
+
+			It("bounds the concurrency with a Semaphore", func() {
+				sem, err := wrpc.NewSemaphore(2)
+				Expect(err).To(BeNil())
+				c := newCounters()
+
+				handles := goOnWorkers(acquireCells, map[string]wrpc.Shareable{"sem": sem, "counters": c})
+				contend(2, 5, func() {
+					sem.Acquire()
+					c.enter()
+					c.leave()
+					sem.Release()
+				})
+				for _, h := range handles {
+					Expect(wait(h)).To(Succeed())
+				}
+
+				Expect(c.load(totalCell)).To(Equal(int32(workerCount*3*5 + 2*5)))
+				Expect(c.load(maxCell)).To(Equal(int32(2)))
+			})
+
+			It("runs a Once exactly once across workers", func() {
+				once, err := wrpc.NewOnce()
+				Expect(err).To(BeNil())
+				c := newCounters()
+
+				handles := goOnWorkers(doOnce, map[string]wrpc.Shareable{"once": once, "counters": c})
+				contend(2, 2, func() {
+					once.Do(func() {
+						c.enter()
+						time.Sleep(20 * time.Millisecond)
+						c.leave()
+					})
+					if c.load(totalCell) != 1 {
+						c.add(overlapCell, 1)
+					}
+				})
+				for _, h := range handles {
+					Expect(wait(h)).To(Succeed())
+				}
+
+				Expect(c.load(totalCell)).To(Equal(int32(1)))
+				Expect(c.load(overlapCell)).To(BeZero())
+			})
+		})
+	}
+
+	It("tries to lock a Mutex held by another worker", func() {
+		mu, err := wrpc.NewMutex()
+		Expect(err).To(BeNil())
+		shared := map[string]wrpc.Shareable{"mu": mu}
+
+		Expect(mu.TryLock()).To(BeTrue())
+		Expect(mu.TryLock()).To(BeFalse())
+
+		out := &buffer{}
+		Expect(wait(wrpc.GoWith(nil, out, tryLock, wrpc.CallOptions{Shared: shared}))).To(Succeed())
+		Expect(out.String()).To(Equal("busy"))
+
+		mu.Unlock()
+		out = &buffer{}
+		Expect(wait(wrpc.GoWith(nil, out, tryLock, wrpc.CallOptions{Shared: shared}))).To(Succeed())
+		Expect(out.String()).To(Equal("locked"))
+		Expect(mu.TryLock()).To(BeTrue())
+		mu.Unlock()
+	})
+
+	It("rejects values that are not shared", func() {
+		_, err := wrpc.MutexFromJS(js.ValueOf(map[string]interface{}{"id": "x"}))
+		Expect(err).NotTo(BeNil())
+		_, err = wrpc.SemaphoreFromJS(js.Undefined())
+		Expect(err).NotTo(BeNil())
+	})
+})
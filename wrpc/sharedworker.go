@@ -0,0 +1,163 @@
+// +build js,wasm
+
+package wrpc
+
+import (
+	"context"
+	"fmt"
+	"syscall/js"
+
+	"github.com/joomcode/errorx"
+	"github.com/mgnsk/jsutil/logger"
+)
+
+// sharedBootstrapJS runs this program in a SharedWorker.
+// Pages that connect before the program calls RunSharedServer are queued.
+const sharedBootstrapJS = `"use strict";
+(() => {
+	const moduleURL = %[1]s;
+	const wasmExecURL = %[2]s;
+
+	importScripts(wasmExecURL);
+
+	self.wrpcConnects = [];
+	self.onconnect = (event) => self.wrpcConnects.push(event);
+
+	const compile = () => {
+		if (typeof WebAssembly.compileStreaming === "function") {
+			return WebAssembly.compileStreaming(fetch(moduleURL));
+		}
+		return fetch(moduleURL).then((res) => res.arrayBuffer()).then((buf) => WebAssembly.compile(buf));
+	};
+
+	compile()
+		.then((module) => {
+			const go = new Go();
+			go.argv = [moduleURL];
+			return WebAssembly.instantiate(module, go.importObject).then((instance) => go.run(instance));
+		})
+		.catch((err) => console.error("wrpc: shared worker bootstrap failed:", err));
+})();
+`
+
+// SharedWorkerSource returns a script that runs this program in a SharedWorker.
+// Pages share a worker only when they load it from the same URL,
+// so the script must be served rather than created from an object URL.
+// The program must call RunSharedServer.
+func (b Bootstrap) SharedWorkerSource() []byte {
+	return []byte(fmt.Sprintf(sharedBootstrapJS, jsString(b.resolve(b.ModuleURL)), jsString(b.resolve(b.WasmExecURL))))
+}
+
+// InSharedWorker reports whether this program runs in a SharedWorker.
+func InSharedWorker() bool {
+	return js.Global().Get("SharedWorkerGlobalScope").Type() == js.TypeFunction
+}
+
+// RunSharedServer runs the wrpc server in a SharedWorker.
+// Each connecting page gets its own scheduler session. The calls of a page
+// run on this worker and are stopped when the page disconnects.
+// It blocks until ctx is done.
+func RunSharedServer(ctx context.Context) error {
+	if !InSharedWorker() {
+		return errorx.IllegalState.New("must have shared worker environment")
+	}
+
+	logger.Info("wrpc: shared worker started")
+
+	connect := func(event js.Value) {
+		ports := event.Get("ports")
+		if ports.Type() != js.TypeObject || ports.Length() == 0 || !isPort(ports.Index(0)) {
+			logger.Error("wrpc: invalid connect event")
+			return
+		}
+		session := pages.accept(newJSTransport(ports.Index(0)))
+		logger.Debug("wrpc: page connected", logger.F("session", session.id))
+	}
+
+	onconnect := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		connect(args[0])
+		return nil
+	})
+	defer onconnect.Release()
+	js.Global().Set("onconnect", onconnect)
+
+	// Accept the pages that connected during startup.
+	if queued := js.Global().Get("wrpcConnects"); queued.Type() == js.TypeObject {
+		for i := 0; i < queued.Length(); i++ {
+			connect(queued.Index(i))
+		}
+		js.Global().Delete("wrpcConnects")
+	}
+
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// SharedWorker is the connection of this page to a wrpc server in a SharedWorker.
+type SharedWorker struct {
+	worker     js.Value
+	port       *MessagePort
+	onpagehide js.Func
+}
+
+// ConnectSharedWorker connects to the SharedWorker at url with name,
+// starting it if no other page has. The worker must run RunSharedServer,
+// for example with the script of Bootstrap.SharedWorkerSource.
+// Calls are scheduled to the shared worker along with the dedicated workers.
+// It waits until the server answers or ctx is done.
+func ConnectSharedWorker(ctx context.Context, url, name string) (*SharedWorker, error) {
+	ctor := js.Global().Get("SharedWorker")
+	if ctor.Type() != js.TypeFunction {
+		return nil, errorx.UnsupportedOperation.New("SharedWorker is not available")
+	}
+
+	worker := ctor.New(url, map[string]interface{}{"name": name})
+	w := &SharedWorker{
+		worker: worker,
+		port:   NewMessagePort(worker.Get("port")),
+	}
+
+	select {
+	case <-w.port.RemoteReady():
+	case <-ctx.Done():
+		w.port.Close()
+		return nil, errorx.Decorate(ctx.Err(), "shared worker %s did not answer", url)
+	}
+
+	go func() {
+		err := GlobalScheduler.RunScheduler(w.port.ctx, w.port)
+		logger.Debug("wrpc: shared worker scheduling stopped", logger.F("err", err))
+	}()
+	go ping(w.port, PageTimeout)
+
+	// Let the worker end the session when the page goes away.
+	// The worker also ends it when the pings stop without a pagehide.
+	w.onpagehide = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		w.Close()
+		return nil
+	})
+	if js.Global().Get("addEventListener").Type() == js.TypeFunction {
+		js.Global().Call("addEventListener", "pagehide", w.onpagehide)
+	}
+
+	return w, nil
+}
+
+// MessagePort returns the port to the shared worker.
+func (w *SharedWorker) MessagePort() *MessagePort {
+	return w.port
+}
+
+// JSValue returns the underlying js SharedWorker.
+func (w *SharedWorker) JSValue() js.Value {
+	return w.worker
+}
+
+// Close ends the session of this page. The calls it still runs are stopped.
+func (w *SharedWorker) Close() error {
+	if js.Global().Get("removeEventListener").Type() == js.TypeFunction {
+		js.Global().Call("removeEventListener", "pagehide", w.onpagehide)
+	}
+	w.onpagehide.Release()
+	return w.port.Close()
+}
@@ -0,0 +1,95 @@
+// +build js,wasm
+
+package wrpc
+
+import (
+	"syscall/js"
+
+	"github.com/joomcode/errorx"
+	"github.com/mgnsk/jsutil/array"
+)
+
+// SpawnOptions configures a spawned worker. Args and Env are set by the
+// bootstrap script before the program starts, the other options are sent
+// with the main port before the worker receives any calls.
+type SpawnOptions struct {
+	// Args replace os.Args of the worker when not empty.
+	// They need a Bootstrap, a worker started from IndexJS cannot be spawned with them.
+	Args []string
+	// Env is added to the environment of the worker.
+	// It needs a Bootstrap like Args.
+	Env map[string]string
+	// Config is passed to the worker as is, for example its role or a seed.
+	// The worker reads it with WorkerSpawnOptions.
+	Config []byte
+	// ForwardOutput forwards the stdout, stderr and console output
+	// of the worker to the main thread once it has received its main port.
+	ForwardOutput bool
+	// Sink receives the forwarded output. Defaults to a ConsoleSink.
+	Sink OutputSink
+}
+
+// spawnOptions are the options this worker was spawned with.
+var spawnOptions SpawnOptions
+
+// WorkerSpawnOptions returns the options this worker was spawned with.
+// The options are set before the worker receives any calls.
+// Args and Env are not set, they are in os.Args and the environment from the start.
+func WorkerSpawnOptions() SpawnOptions {
+	return spawnOptions
+}
+
+// addArgsTo adds the args and the environment to the first message of the bootstrap script.
+func (o SpawnOptions) addArgsTo(message map[string]interface{}) {
+	if len(o.Args) > 0 {
+		args := make([]interface{}, len(o.Args))
+		for i, arg := range o.Args {
+			args[i] = arg
+		}
+		message["argv"] = args
+	}
+
+	if len(o.Env) > 0 {
+		env := make(map[string]interface{}, len(o.Env))
+		for k, v := range o.Env {
+			env[k] = v
+		}
+		message["env"] = env
+	}
+}
+
+// addTo adds the options to the main port message.
+func (o SpawnOptions) addTo(message map[string]interface{}) (transferables []interface{}, err error) {
+	if len(o.Config) > 0 {
+		arr, err := array.CreateBufferFromSlice(o.Config)
+		if err != nil {
+			return nil, errorx.Decorate(err, "error encoding config")
+		}
+		message["config"] = arr.JSValue()
+		transferables = append(transferables, arr.JSValue())
+	}
+
+	if o.ForwardOutput {
+		message["forward_output"] = true
+	}
+
+	return transferables, nil
+}
+
+// spawnOptionsFromJS decodes the options from the main port message.
+// Args and Env are not in the message, they are in os.Args and the environment.
+func spawnOptionsFromJS(data js.Value) (SpawnOptions, error) {
+	var o SpawnOptions
+
+	if config := data.Get("config"); config.Type() == js.TypeObject {
+		b, err := copyBuffer(config)
+		if err != nil {
+			return o, errorx.Decorate(err, "error decoding config")
+		}
+		o.Config = b
+	}
+
+	o.ForwardOutput = data.Get("forward_output").Truthy()
+
+	return o, nil
+}
@@ -0,0 +1,115 @@
+package wrpc
+
+import (
+	"io"
+)
+
+// portState is the lifecycle state of a MessagePort.
+// It is guarded by the mutex of the port.
+type portState int
+
+const (
+	// portOpen reads and writes in both directions.
+	portOpen portState = iota
+	// portHalfClosed has a direction closed by CloseWrite or CloseRead on either end.
+	portHalfClosed
+	// portEOF was closed by the remote end.
+	portEOF
+	// portClosed was closed by this end.
+	portClosed
+	// portErrored received data it could not read. Reads and writes fail with its error.
+	portErrored
+)
+
+var stateNames = []string{
+	portOpen:       "open",
+	portHalfClosed: "half-closed",
+	portEOF:        "EOF",
+	portClosed:     "closed",
+	portErrored:    "errored",
+}
+
+func (s portState) String() string {
+	return stateNames[s]
+}
+
+// portTransitions are the states that each state can move to.
+// EOF and closed are final.
+var portTransitions = map[portState][]portState{
+	portOpen:       {portHalfClosed, portEOF, portClosed, portErrored},
+	portHalfClosed: {portEOF, portClosed, portErrored},
+	portErrored:    {portEOF, portClosed},
+}
+
+// shutFlags are the closed directions of a half-closed port.
+type shutFlags uint8
+
+const (
+	// shutWrite is set by CloseWrite.
+	shutWrite shutFlags = 1 << iota
+	// shutRead is set by CloseRead.
+	shutRead
+	// remoteShutWrite is set when the remote end does not write anymore.
+	remoteShutWrite
+	// remoteShutRead is set when the remote end does not read anymore.
+	remoteShutRead
+)
+
+// setStateLocked moves the port to state. It reports false
+// when the port cannot move there from its current state. port.mu must be held.
+func (port *MessagePort) setStateLocked(state portState) bool {
+	if port.state == state {
+		return true
+	}
+	for _, next := range portTransitions[port.state] {
+		if next == state {
+			port.state = state
+			return true
+		}
+	}
+	return false
+}
+
+// shutLocked closes the direction flag in an open or half-closed port.
+// It reports false when the port is past those states. port.mu must be held.
+func (port *MessagePort) shutLocked(flag shutFlags) bool {
+	if port.state != portOpen && port.state != portHalfClosed {
+		return false
+	}
+	port.shut |= flag
+	port.state = portHalfClosed
+	return true
+}
+
+// writeErrLocked returns the error of a write in the current state
+// or nil when the port can be written. port.mu must be held.
+func (port *MessagePort) writeErrLocked() error {
+	switch {
+	case port.state == portEOF:
+		return io.EOF
+	case port.state == portClosed:
+		return io.ErrClosedPipe
+	case port.state == portErrored:
+		return port.err
+	case port.shut&shutWrite != 0:
+		return io.ErrClosedPipe
+	case port.shut&remoteShutRead != 0:
+		return io.EOF
+	}
+	return nil
+}
+
+// fail moves the port to the errored state.
+// Reads fail with err once the data before it is read.
+func (port *MessagePort) fail(err error) {
+	port.mu.Lock()
+	ok := port.setStateLocked(portErrored)
+	if ok {
+		port.err = err
+	}
+	port.mu.Unlock()
+
+	if ok {
+		port.recvWriter.CloseWithError(err)
+	}
+}
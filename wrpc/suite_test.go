@@ -0,0 +1,30 @@
+// +build js,wasm
+
+package wrpc_test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/mgnsk/jsutil"
+	"github.com/mgnsk/jsutil/wrpc"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// TestMain runs the wrpc server when the test binary is started in a worker.
+func TestMain(m *testing.M) {
+	if jsutil.IsWorker {
+		if err := wrpc.RunServer(context.Background()); err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+	os.Exit(m.Run())
+}
+
+func TestWRPC(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "wrpc")
+}
@@ -0,0 +1,547 @@
+// +build js,wasm
+
+package wrpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+	"syscall/js"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"github.com/mgnsk/jsutil/logger"
+)
+
+// tabKey marks the messages of a tab group on its BroadcastChannel.
+const tabKey = "wrpc_tab"
+
+// TabOptions configures JoinTabs.
+type TabOptions struct {
+	// Interval is the heartbeat interval of the tabs. It defaults to one second.
+	Interval time.Duration
+	// Timeout is how long a silent tab is considered alive.
+	// It defaults to three intervals.
+	Timeout time.Duration
+}
+
+// TabGroup is a group of tabs of the same origin connected over a BroadcastChannel.
+// The oldest live tab is the leader. It owns the workers and runs the calls
+// of the other tabs. A BroadcastChannel cannot transfer MessagePorts,
+// so the streams of the forwarded calls are carried by the channel itself.
+type TabGroup struct {
+	id      string
+	channel js.Value
+	opts    TabOptions
+
+	onmessage js.Func
+	cancel    context.CancelFunc
+
+	mu       sync.Mutex
+	closed   bool
+	peers    map[string]time.Time
+	leader   string
+	changed  chan struct{}
+	streams  map[string]*tabStream
+	pending  map[string]*pendingTabCall
+	sequence uint64
+}
+
+// pendingTabCall is a call forwarded to the leader.
+type pendingTabCall struct {
+	leader string
+	result chan error
+}
+
+// JoinTabs joins the tab group name. It waits one interval
+// for the other tabs to answer before electing the leader.
+func JoinTabs(ctx context.Context, name string, opts TabOptions) (*TabGroup, error) {
+	if opts.Interval <= 0 {
+		opts.Interval = time.Second
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 3 * opts.Interval
+	}
+
+	ctor := js.Global().Get("BroadcastChannel")
+	if ctor.Type() != js.TypeFunction {
+		return nil, errorx.IllegalState.New("BroadcastChannel is not supported")
+	}
+
+	id, err := newTabID()
+	if err != nil {
+		return nil, err
+	}
+
+	g := &TabGroup{
+		id:      id,
+		channel: ctor.New(name),
+		opts:    opts,
+		peers:   map[string]time.Time{},
+		leader:  id,
+		changed: make(chan struct{}),
+		streams: map[string]*tabStream{},
+		pending: map[string]*pendingTabCall{},
+	}
+
+	g.onmessage = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		// A hostile message must not crash the tab.
+		defer func() {
+			if r := recover(); r != nil {
+				logger.Error("wrpc: TabGroup: panic handling message", logger.F("panic", r))
+			}
+		}()
+		g.handle(args[0].Get("data"))
+		return nil
+	})
+	g.channel.Set("onmessage", g.onmessage)
+
+	var runCtx context.Context
+	runCtx, g.cancel = context.WithCancel(context.Background())
+	go g.run(runCtx)
+
+	g.post(map[string]interface{}{tabKey: "hello"})
+
+	select {
+	case <-time.After(opts.Interval):
+	case <-ctx.Done():
+		g.Close()
+		return nil, errorx.Decorate(ctx.Err(), "error joining tabs %s", name)
+	}
+
+	return g, nil
+}
+
+// newTabID returns an ID that orders tabs by age.
+func newTabID() (string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", errorx.Decorate(err, "error creating tab ID")
+	}
+	return fmt.Sprintf("%016x-%s", time.Now().UnixNano(), hex.EncodeToString(suffix)), nil
+}
+
+// ID returns the ID of this tab.
+func (g *TabGroup) ID() string {
+	return g.id
+}
+
+// Leader returns the ID of the leader tab.
+func (g *TabGroup) Leader() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.leader
+}
+
+// IsLeader reports whether this tab is the leader.
+func (g *TabGroup) IsLeader() bool {
+	return g.Leader() == g.id
+}
+
+// LeaderChanged returns a channel that is closed when the leader changes.
+func (g *TabGroup) LeaderChanged() <-chan struct{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.changed
+}
+
+// Go runs f on the workers of the leader tab and streams the result back.
+// The leader runs it with Go.
+func (g *TabGroup) Go(in io.Reader, out io.WriteCloser, f RemoteCall) *Handle {
+	h := newHandle()
+	defer h.seal()
+
+	if out == nil {
+		h.fail(errorx.IllegalArgument.New("must have output"))
+		return h
+	}
+	if err := checkRegistered(f); err != nil {
+		h.fail(err)
+		return h
+	}
+
+	g.mu.Lock()
+	leader, closed := g.leader, g.closed
+	g.mu.Unlock()
+
+	if closed {
+		h.fail(errorx.IllegalState.New("tab group closed"))
+		return h
+	}
+	if leader == g.id {
+		h.join(Go(in, out, f))
+		return h
+	}
+
+	call := map[string]interface{}{
+		tabKey: "call",
+		"to":   leader,
+		"rc":   int(callID(f)),
+	}
+
+	outKey := g.nextKey()
+	outPort := NewPort(g.stream(leader, outKey))
+	call["output"] = outKey
+
+	var inPort *MessagePort
+	if in != nil {
+		inKey := g.nextKey()
+		inPort = newPort(g.stream(leader, inKey))
+		call["input"] = inKey
+	}
+
+	result := make(chan error, 1)
+	g.mu.Lock()
+	g.pending[outKey] = &pendingTabCall{leader: leader, result: result}
+	g.mu.Unlock()
+
+	g.post(call)
+
+	if inPort != nil {
+		inPort.start()
+		h.run(func() error {
+			defer inPort.Close()
+
+			select {
+			case <-inPort.RemoteReady():
+			case <-time.After(g.opts.Timeout):
+				return errorx.TimeoutElapsed.New("waited for input port ready in %s", g.opts.Timeout)
+			}
+
+			if _, err := io.Copy(inPort, in); err != nil {
+				return errorx.Decorate(err, "error copying input")
+			}
+			return nil
+		})
+	}
+
+	h.run(func() error {
+		defer out.Close()
+		if _, err := io.Copy(out, outPort); err != nil {
+			return errorx.Decorate(err, "error copying output")
+		}
+		return nil
+	})
+
+	h.run(func() error {
+		return <-result
+	})
+
+	return h
+}
+
+// Close leaves the group. The streams of forwarded calls are closed.
+func (g *TabGroup) Close() error {
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return nil
+	}
+	// Only the first Close gets past here. Later posts are dropped.
+	g.closed = true
+	g.mu.Unlock()
+
+	g.channel.Call("postMessage", map[string]interface{}{tabKey: "bye", "from": g.id})
+
+	g.cancel()
+	g.channel.Set("onmessage", js.Null())
+	g.channel.Call("close")
+	g.onmessage.Release()
+
+	g.dropPeers(func(string) bool { return true }, errorx.IllegalState.New("tab group closed"))
+	return nil
+}
+
+// run posts the heartbeats and expires the silent tabs.
+func (g *TabGroup) run(ctx context.Context) {
+	ticker := time.NewTicker(g.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			g.post(map[string]interface{}{tabKey: "heartbeat"})
+
+			now := time.Now()
+			g.mu.Lock()
+			expired := map[string]bool{}
+			for id, seen := range g.peers {
+				if now.Sub(seen) > g.opts.Timeout {
+					expired[id] = true
+				}
+			}
+			g.mu.Unlock()
+
+			if len(expired) > 0 {
+				g.dropPeers(func(id string) bool { return expired[id] }, errorx.TimeoutElapsed.New("tab timed out"))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// post posts a message from this tab to the group.
+// Messages are dropped after Close.
+func (g *TabGroup) post(message map[string]interface{}) {
+	g.mu.Lock()
+	closed := g.closed
+	g.mu.Unlock()
+	if closed {
+		return
+	}
+	message["from"] = g.id
+	g.channel.Call("postMessage", message)
+}
+
+func (g *TabGroup) handle(data js.Value) {
+	if data.Type() != js.TypeObject {
+		return
+	}
+	kind, from := data.Get(tabKey), data.Get("from")
+	if kind.Type() != js.TypeString || from.Type() != js.TypeString || from.String() == g.id {
+		return
+	}
+	if to := data.Get("to"); to.Type() != js.TypeUndefined && (to.Type() != js.TypeString || to.String() != g.id) {
+		return
+	}
+	peer := from.String()
+
+	switch kind.String() {
+	case "hello":
+		g.seen(peer)
+		// Let the new tab know us before it elects the leader.
+		g.post(map[string]interface{}{tabKey: "heartbeat"})
+
+	case "heartbeat":
+		g.seen(peer)
+
+	case "bye":
+		g.dropPeers(func(id string) bool { return id == peer }, errorx.IllegalState.New("tab %s left", peer))
+
+	case "stream":
+		key := data.Get("stream")
+		msg, ok := decodeMessage(data.Get("msg"))
+		if key.Type() != js.TypeString || !ok || !isStreamKind(msg.Kind) {
+			logger.Error("wrpc: TabGroup: invalid stream message", logger.F("tab", peer))
+			return
+		}
+		g.mu.Lock()
+		s, ok := g.streams[key.String()]
+		g.mu.Unlock()
+		if ok && s.peer == peer {
+			s.deliver(msg)
+		}
+
+	case "call":
+		g.seen(peer)
+		if err := g.serve(peer, data); err != nil {
+			logger.Error("wrpc: TabGroup: rejected call", logger.F("tab", peer), logger.F("err", err))
+		}
+
+	case "result":
+		key := data.Get("call")
+		if key.Type() != js.TypeString {
+			logger.Error("wrpc: TabGroup: invalid result", logger.F("tab", peer))
+			return
+		}
+		var err error
+		if msg := data.Get("err"); msg.Type() == js.TypeString {
+			err = errorx.ExternalError.New("tab %s: %s", peer, msg.String())
+		}
+		g.finish(key.String(), peer, err)
+	}
+}
+
+// serve runs a call forwarded by peer and posts its result back.
+func (g *TabGroup) serve(peer string, data js.Value) error {
+	outKey, inKey, rc := data.Get("output"), data.Get("input"), data.Get("rc")
+	if outKey.Type() != js.TypeString {
+		return errorx.IllegalFormat.New("invalid call output")
+	}
+
+	reply := func(err error) {
+		result := map[string]interface{}{tabKey: "result", "to": peer, "call": outKey.String()}
+		if err != nil {
+			result["err"] = err.Error()
+		}
+		g.post(result)
+	}
+
+	out := NewPort(g.stream(peer, outKey.String()))
+
+	var in io.Reader
+	switch {
+	case inKey.Type() == js.TypeString:
+		in = struct{ io.Reader }{NewPort(g.stream(peer, inKey.String()))}
+	case inKey.Type() != js.TypeUndefined:
+		out.Close()
+		err := errorx.IllegalFormat.New("invalid call input")
+		reply(err)
+		return err
+	}
+
+	if !isInt(rc) || rc.Float() < 0 {
+		out.Close()
+		err := errorx.IllegalFormat.New("invalid remote call")
+		reply(err)
+		return err
+	}
+	f, ok := lookupCall(uintptr(rc.Float()))
+	if !ok {
+		out.Close()
+		err := errorx.IllegalArgument.New("remote call %d is not registered", rc.Int())
+		reply(err)
+		return err
+	}
+
+	// Hide the ports from Go so that the call gets ports it can transfer to a worker.
+	h := Go(in, struct{ io.WriteCloser }{out}, f)
+	go func() {
+		reply(h.Wait())
+	}()
+	return nil
+}
+
+// seen records a live peer and elects the leader.
+func (g *TabGroup) seen(peer string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return
+	}
+	g.peers[peer] = time.Now()
+	g.electLocked()
+}
+
+// dropPeers forgets the matching peers and ends their streams and calls with err.
+func (g *TabGroup) dropPeers(match func(id string) bool, err error) {
+	g.mu.Lock()
+	for id := range g.peers {
+		if match(id) {
+			delete(g.peers, id)
+		}
+	}
+	g.electLocked()
+
+	var streams []*tabStream
+	for key, s := range g.streams {
+		if match(s.peer) {
+			streams = append(streams, s)
+			delete(g.streams, key)
+		}
+	}
+	var calls []*pendingTabCall
+	for key, c := range g.pending {
+		if match(c.leader) {
+			calls = append(calls, c)
+			delete(g.pending, key)
+		}
+	}
+	g.mu.Unlock()
+
+	for _, s := range streams {
+		s.deliver(Message{Kind: MessageEOF})
+	}
+	for _, c := range calls {
+		c.result <- err
+	}
+}
+
+// electLocked makes the oldest live tab the leader.
+func (g *TabGroup) electLocked() {
+	leader := g.id
+	for id := range g.peers {
+		if id < leader {
+			leader = id
+		}
+	}
+	if leader != g.leader {
+		g.leader = leader
+		close(g.changed)
+		g.changed = make(chan struct{})
+	}
+}
+
+// finish delivers the result of a forwarded call.
+func (g *TabGroup) finish(key, leader string, err error) {
+	g.mu.Lock()
+	c, ok := g.pending[key]
+	if ok && c.leader == leader {
+		delete(g.pending, key)
+	}
+	g.mu.Unlock()
+
+	if ok && c.leader == leader {
+		c.result <- err
+	}
+}
+
+// nextKey returns a new stream key that is unique in the group.
+func (g *TabGroup) nextKey() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.sequence++
+	return fmt.Sprintf("%s/%d", g.id, g.sequence)
+}
+
+// stream creates the transport of the stream key to peer.
+func (g *TabGroup) stream(peer, key string) *tabStream {
+	s := &tabStream{group: g, peer: peer, key: key}
+	g.mu.Lock()
+	g.streams[key] = s
+	g.mu.Unlock()
+	return s
+}
+
+// tabStream is a Transport for one stream between two tabs.
+// Messages are queued until it listens.
+type tabStream struct {
+	streamInbox
+	group *TabGroup
+	peer  string
+	key   string
+}
+
+// Post posts msg to the stream on the peer tab.
+func (s *tabStream) Post(msg Message) error {
+	if !isStreamKind(msg.Kind) {
+		return errorx.IllegalArgument.New("cannot send message kind %d to a tab", msg.Kind)
+	}
+
+	s.group.mu.Lock()
+	closed := s.group.closed
+	s.group.mu.Unlock()
+	if closed {
+		return errorx.IllegalState.New("tab group closed")
+	}
+
+	// The payload is cloned by the channel.
+	encoded, _, err := encodeMessage(msg)
+	if err != nil {
+		return err
+	}
+	s.group.post(map[string]interface{}{
+		tabKey:   "stream",
+		"to":     s.peer,
+		"stream": s.key,
+		"msg":    encoded,
+	})
+	return nil
+}
+
+func (s *tabStream) carriesDeflate() bool {
+	return true
+}
+
+// Close stops receiving messages of the stream.
+func (s *tabStream) Close() {
+	s.group.mu.Lock()
+	if s.group.streams[s.key] == s {
+		delete(s.group.streams, s.key)
+	}
+	s.group.mu.Unlock()
+}
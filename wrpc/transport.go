@@ -0,0 +1,131 @@
+package wrpc
+
+import (
+	"sync"
+
+	"github.com/mgnsk/jsutil/logger"
+)
+
+// MessageKind is the type of a protocol message.
+type MessageKind int
+
+const (
+	// MessageReady tells the other end that the port started listening.
+	MessageReady MessageKind = iota
+	// MessageAck acknowledges that a MessageData was read
+	// or that a MessageTopic was queued for the subscribers.
+	MessageAck
+	// MessageDone tells a scheduler that its call is done.
+	MessageDone
+	// MessageEOF tells the other end that the port was closed.
+	MessageEOF
+	// MessageData carries a write.
+	MessageData
+	// MessageTopic carries a published topic message.
+	MessageTopic
+	// MessageCall carries a remote call.
+	MessageCall
+	// MessageOutput carries output that a worker wrote to stdout or stderr.
+	MessageOutput
+	// MessageLog carries a console log entry of a worker.
+	MessageLog
+	// MessageHello tells a linked thread the worker ID of the sender.
+	MessageHello
+	// MessageService announces that a service is up or down on the sender.
+	MessageService
+	// MessageOpen opens a stream to a service.
+	MessageOpen
+	// MessagePing tells a shared worker that the page that sent it is still there.
+	MessagePing
+)
+
+// Shutdown is the direction of a port closed by MessageEOF.
+type Shutdown int
+
+const (
+	// ShutdownBoth closes the port.
+	ShutdownBoth Shutdown = iota
+	// ShutdownWrite tells that the sender does not write anymore.
+	ShutdownWrite
+	// ShutdownRead tells that the sender does not read anymore.
+	ShutdownRead
+)
+
+// Message is a protocol message between the two ends of a transport.
+type Message struct {
+	Kind MessageKind
+	// Data is the payload of MessageData, MessageTopic and MessageOutput.
+	Data []byte
+	// Topic is the topic of MessageTopic.
+	Topic string
+	// Call is the call of MessageCall.
+	Call *CallMessage
+	// FD is the file descriptor of MessageOutput.
+	FD int
+	// Entry is the entry of MessageLog.
+	Entry *logger.Entry
+	// ID is the worker ID of the sender of MessageHello and MessageService.
+	ID int
+	// Service is the service of MessageService and MessageOpen.
+	Service *ServiceMessage
+	// Deflate tells on MessageReady that the sender accepts compressed data
+	// and on MessageData that Data is compressed.
+	Deflate bool
+	// Shutdown is the direction closed by the sender of MessageEOF.
+	Shutdown Shutdown
+	// Err is set by the transport when a received message could not be decoded.
+	Err error
+}
+
+// CallMessage is a remote call in transit.
+// Its transports are transferred to the receiver.
+type CallMessage struct {
+	RemoteCall RemoteCall
+	// Input is nil when the call has no input.
+	Input  Transport
+	Output Transport
+	Shared map[string]interface{}
+	// Pinned calls are not rescheduled and no MessageDone is sent for them.
+	Pinned bool
+	// Compress enables the compression of the ports of the call.
+	Compress bool
+}
+
+// ServiceMessage is a service announcement or a stream opened to a service.
+type ServiceMessage struct {
+	Name string
+	// Up is false when the service was unregistered.
+	Up bool
+	// Conn is the transport of the stream of MessageOpen.
+	// It is transferred to the receiver.
+	Conn Transport
+}
+
+// Transport is one end of a message channel.
+type Transport interface {
+	// Post sends msg to the other end.
+	Post(msg Message) error
+	// Listen starts delivering the messages from the other end to handler in order.
+	// Messages received before Listen are queued.
+	Listen(handler func(Message))
+	// Close closes the channel.
+	Close()
+}
+
+// deflateTransport is implemented by the transports that deliver the Deflate flag
+// of data messages. Ports only accept compressed writes over them.
+type deflateTransport interface {
+	carriesDeflate() bool
+}
+
+// carriesDeflate reports whether t delivers the Deflate flag of data messages.
+func carriesDeflate(t Transport) bool {
+	dt, ok := t.(deflateTransport)
+	return ok && dt.carriesDeflate()
+}
+
+var (
+	channelMu sync.RWMutex
+	// newChannel creates the transports of Pipe.
+	newChannel = NewMemoryChannel
+)
@@ -0,0 +1,154 @@
+// +build js,wasm
+
+package wrpc
+
+import (
+	"context"
+	"io"
+	"sync"
+	"syscall/js"
+
+	"github.com/joomcode/errorx"
+	"github.com/mgnsk/jsutil/array"
+)
+
+// DialWebSocket opens a session to a wrpc server at url, for example
+// a native Go process serving package wsserver.
+// The server may run calls by name. calls may be nil.
+func DialWebSocket(ctx context.Context, url string, calls map[string]RemoteCall) (*Session, error) {
+	ctor := js.Global().Get("WebSocket")
+	if ctor.Type() != js.TypeFunction {
+		return nil, errorx.IllegalState.New("WebSocket is not supported")
+	}
+
+	c := &wsConn{
+		ws:     ctor.New(url),
+		opened: make(chan struct{}),
+		dead:   make(chan struct{}),
+		wake:   make(chan struct{}, 1),
+	}
+	c.ws.Set("binaryType", "arraybuffer")
+
+	c.onopen = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		close(c.opened)
+		return nil
+	})
+	c.onmessage = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		frame, err := copyBuffer(args[0].Get("data"))
+		if err != nil {
+			// Text frames are not part of the protocol.
+			c.fail(errorx.Decorate(err, "invalid frame"))
+			c.ws.Call("close")
+			return nil
+		}
+		c.push(frame)
+		return nil
+	})
+	c.onclose = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		c.fail(io.EOF)
+		c.release()
+		return nil
+	})
+	c.ws.Set("onopen", c.onopen)
+	c.ws.Set("onmessage", c.onmessage)
+	c.ws.Set("onclose", c.onclose)
+
+	select {
+	case <-c.opened:
+	case <-c.dead:
+		return nil, errorx.ExternalError.New("error connecting to %s", url)
+	case <-ctx.Done():
+		c.Close()
+		return nil, errorx.Decorate(ctx.Err(), "error connecting to %s", url)
+	}
+
+	return NewSession(c, calls), nil
+}
+
+// wsConn is a FrameConn over a js WebSocket.
+type wsConn struct {
+	ws                         js.Value
+	onopen, onmessage, onclose js.Func
+	opened                     chan struct{}
+
+	// dead is closed when the connection has failed.
+	dead chan struct{}
+
+	mu     sync.Mutex
+	frames [][]byte
+	err    error
+	wake   chan struct{}
+}
+
+func (c *wsConn) push(frame []byte) {
+	c.mu.Lock()
+	c.frames = append(c.frames, frame)
+	c.mu.Unlock()
+	c.signal()
+}
+
+// fail ends the connection with err after the queued frames are read.
+func (c *wsConn) fail(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+		close(c.dead)
+	}
+	c.mu.Unlock()
+	c.signal()
+}
+
+func (c *wsConn) signal() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (c *wsConn) release() {
+	c.onopen.Release()
+	c.onmessage.Release()
+	c.onclose.Release()
+}
+
+// ReadFrame returns the next received frame.
+func (c *wsConn) ReadFrame() ([]byte, error) {
+	for {
+		c.mu.Lock()
+		if len(c.frames) > 0 {
+			frame := c.frames[0]
+			c.frames = c.frames[1:]
+			c.mu.Unlock()
+			return frame, nil
+		}
+		err := c.err
+		c.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		<-c.wake
+	}
+}
+
+// WriteFrame sends frame as a binary message.
+func (c *wsConn) WriteFrame(frame []byte) error {
+	c.mu.Lock()
+	err := c.err
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	buf, err := array.CreateBufferFromSlice(frame)
+	if err != nil {
+		return err
+	}
+	c.ws.Call("send", buf.JSValue())
+	return nil
+}
+
+// Close closes the WebSocket.
+func (c *wsConn) Close() error {
+	c.ws.Call("close")
+	return nil
+}
@@ -3,51 +3,84 @@
 package wrpc
 
 import (
+	"sync/atomic"
 	"syscall/js"
 	"time"
 
 	"github.com/joomcode/errorx"
-	"github.com/mgnsk/jsutil"
 )
 
 // IndexJS boots up webworker go main.
+// When nil, SpawnWorker uses DefaultBootstrap.
 var IndexJS []byte
 
+// workerCount is the number of created workers. It assigns the worker IDs.
+var workerCount int32
+
 // CreateTimeout specifies timeout for waiting for webworker hello.
 var CreateTimeout = 10 * time.Second
 
 // Worker is a browser thread that communicates through net.Conn interface.
 type Worker struct {
+	id                    int
 	worker                js.Value
-	ack                   chan struct{}
 	port                  *MessagePort
 	remoteListenerStarted chan struct{}
+
+	// ack receives the acks of the worker, with an error for a rejected command.
+	ack chan error
 }
 
-// CreateWorkerFromSource creates a Worker from js source.
+// CreateWorkerFromSource creates a Worker from js source with DefaultWorkerFactory.
 // The worker is terminated when context is canceled.
 func CreateWorkerFromSource(indexJS []byte) (*Worker, error) {
-	url := jsutil.CreateURLObject(string(indexJS), "application/javascript")
-	worker := js.Global().Get("Worker").New(url)
+	return CreateWorker(DefaultWorkerFactory, indexJS)
+}
+
+// CreateWorker creates a Worker from js source with factory.
+func CreateWorker(factory WorkerFactory, indexJS []byte) (*Worker, error) {
+	return createWorker(factory, indexJS, nil, SpawnOptions{})
+}
+
+// createWorker creates a Worker and posts init to it before waiting for it to start.
+// The options are sent along with the main port.
+func createWorker(factory WorkerFactory, indexJS []byte, init map[string]interface{}, opts SpawnOptions) (*Worker, error) {
+	worker, err := factory.NewWorker(indexJS)
+	if err != nil {
+		return nil, err
+	}
 
 	w := &Worker{
+		id:                    int(atomic.AddInt32(&workerCount, 1)),
 		worker:                worker,
-		ack:                   make(chan struct{}),
+		ack:                   make(chan error),
 		remoteListenerStarted: make(chan struct{}),
 	}
 
 	onmessage := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		var err error
+		if msg := args[0].Get("data").Get("error"); msg.Type() == js.TypeString {
+			err = errorx.IllegalState.New("worker %d: %s", w.id, msg.String())
+		}
 		go func() {
-			w.ack <- struct{}{}
+			w.ack <- err
 		}()
 		return nil
 	})
 	worker.Set("onmessage", onmessage)
 	//defer onmessage.Release()
 
+	if init != nil {
+		worker.Call("postMessage", init)
+	}
+
 	// Wait for the ACK signal.
 	select {
-	case <-w.ack:
+	case err := <-w.ack:
+		if err != nil {
+			worker.Call("terminate")
+			return nil, errorx.Decorate(err, "worker failed to start")
+		}
 	case <-time.After(CreateTimeout):
 		worker.Call("terminate")
 		return nil, errorx.TimeoutElapsed.New("ACK timeout: waited for worker to be ready in %s", CreateTimeout)
@@ -58,21 +91,34 @@ func CreateWorkerFromSource(indexJS []byte) (*Worker, error) {
 	messageChannel := js.Global().Get("MessageChannel").New()
 
 	// Create our side of port.
-	w.port = NewMessagePort(messageChannel.Get("port1"))
+	w.port = newPort(newJSTransport(messageChannel.Get("port1")))
+	if opts.ForwardOutput {
+		w.port.output = forward(w.id, opts.Sink)
+	}
+	w.port.start()
+	links.add(w.port)
 
 	// Send port2 and transfer the ownership to the worker.
 	port2 := messageChannel.Get("port2")
 	message := map[string]interface{}{
 		"main_port": port2,
+		"worker_id": w.id,
 	}
-	transfer := []interface{}{
-		port2,
+	transfer, err := opts.addTo(message)
+	if err != nil {
+		worker.Call("terminate")
+		return nil, err
 	}
+	transfer = append(transfer, port2)
 	worker.Call("postMessage", message, transfer)
 
 	// Wait for the worker to acknowledge it received the port.
 	select {
-	case <-w.ack:
+	case err := <-w.ack:
+		if err != nil {
+			worker.Call("terminate")
+			return nil, errorx.Decorate(err, "worker rejected the main port")
+		}
 	case <-time.After(CreateTimeout):
 		worker.Call("terminate")
 		return nil, errorx.TimeoutElapsed.New("ACK timeout: waited for port received ack")
@@ -81,6 +127,11 @@ func CreateWorkerFromSource(indexJS []byte) (*Worker, error) {
 	return w, nil
 }
 
+// ID returns the ID of the worker. The IDs start from 1 in the order the workers were created.
+func (w *Worker) ID() int {
+	return w.id
+}
+
 // JSValue returns the underlying js value.
 func (w *Worker) JSValue() js.Value {
 	return w.worker
@@ -89,16 +140,34 @@ func (w *Worker) JSValue() js.Value {
 // StartRemoteScheduler starts a scheduler on the remote end
 // that schedules to 'to'.
 func (w *Worker) StartRemoteScheduler(to *MessagePort) {
+	w.startLink(to, 0)
+}
+
+// startLink starts a scheduler on the remote end that schedules to 'to'.
+// A link with a nonzero id can be closed with closeLink.
+func (w *Worker) startLink(to *MessagePort, id int) {
 	messages := map[string]interface{}{
 		"start_scheduler": true,
-		"port":            to,
+		"port":            to.JSValue(),
 	}
-	transferables := []interface{}{to}
+	if id != 0 {
+		messages["link_id"] = id
+	}
+	transferables := []interface{}{to.JSValue()}
 	w.JSValue().Call("postMessage", messages, transferables)
 }
 
-// ACK channel.
-func (w *Worker) ACK() <-chan struct{} {
+// closeLink closes the port of the link id on the remote end.
+// The worker does not acknowledge it.
+func (w *Worker) closeLink(id int) {
+	w.JSValue().Call("postMessage", map[string]interface{}{
+		"close_link": id,
+	})
+}
+
+// ACK returns the channel of the acks of the worker.
+// The error is not nil when the worker rejected the command.
+func (w *Worker) ACK() <-chan error {
 	return w.ack
 }
 
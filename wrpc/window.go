@@ -0,0 +1,156 @@
+// +build js,wasm
+
+package wrpc
+
+import (
+	"context"
+	"sync"
+	"syscall/js"
+
+	"github.com/joomcode/errorx"
+	"github.com/mgnsk/jsutil/logger"
+)
+
+// windowKey marks the handshake messages of the window transport.
+const windowKey = "wrpc_window"
+
+// WindowOptions configures AcceptWindow.
+type WindowOptions struct {
+	// Origins are the exact origins that may connect, such as "https://example.com".
+	// The wildcard "*" is not allowed.
+	Origins []string
+	// Window receives the handshake. It defaults to the global object.
+	Window js.Value
+}
+
+// DialWindow connects to AcceptWindow running in the target window, for example
+// the contentWindow of an iframe. The handshake is posted only to origin,
+// which must be exact. The returned port streams over a dedicated MessageChannel.
+// It waits until the target accepts or ctx is done.
+func DialWindow(ctx context.Context, target js.Value, origin string) (*MessagePort, error) {
+	if err := checkOrigin(origin); err != nil {
+		return nil, err
+	}
+	if target.Type() != js.TypeObject {
+		return nil, errorx.IllegalArgument.New("invalid target window")
+	}
+
+	ch := js.Global().Get("MessageChannel").New()
+	local, remote := ch.Get("port1"), ch.Get("port2")
+
+	accepted := make(chan *MessagePort, 1)
+	var once sync.Once
+	onaccept := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		data := args[0].Get("data")
+		if data.Type() != js.TypeObject || data.Get(windowKey).Type() != js.TypeString || data.Get(windowKey).String() != "accept" {
+			logger.Error("wrpc: DialWindow: invalid handshake reply")
+			return nil
+		}
+		once.Do(func() {
+			// Take over the port before the next message is dispatched.
+			accepted <- NewMessagePort(local)
+		})
+		return nil
+	})
+	defer onaccept.Release()
+	local.Set("onmessage", onaccept)
+
+	target.Call("postMessage", map[string]interface{}{windowKey: "connect"}, origin, []interface{}{remote})
+
+	select {
+	case port := <-accepted:
+		return port, nil
+	case <-ctx.Done():
+		local.Set("onmessage", js.Null())
+		local.Call("close")
+		return nil, errorx.Decorate(ctx.Err(), "window %s did not accept", origin)
+	}
+}
+
+// AcceptWindow waits for a DialWindow from one of the allowed origins
+// and returns the port of its MessageChannel.
+// Handshakes from other origins are logged and dropped.
+func AcceptWindow(ctx context.Context, opts WindowOptions) (*MessagePort, error) {
+	if len(opts.Origins) == 0 {
+		return nil, errorx.IllegalArgument.New("no allowed origins")
+	}
+	allowed := make(map[string]bool, len(opts.Origins))
+	for _, origin := range opts.Origins {
+		if err := checkOrigin(origin); err != nil {
+			return nil, err
+		}
+		allowed[origin] = true
+	}
+
+	window := opts.Window
+	if window.Type() != js.TypeObject {
+		window = js.Global()
+	}
+
+	accepted := make(chan *MessagePort, 1)
+	var once sync.Once
+	onmessage := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		event := args[0]
+		data := event.Get("data")
+		if data.Type() != js.TypeObject || data.Get(windowKey).Type() != js.TypeString {
+			// Not for us.
+			return nil
+		}
+
+		origin := event.Get("origin")
+		ports := event.Get("ports")
+		if origin.Type() != js.TypeString || !allowed[origin.String()] {
+			logger.Error("wrpc: AcceptWindow: origin not allowed", logger.F("origin", origin.String()))
+			closePorts(ports)
+			return nil
+		}
+		if data.Get(windowKey).String() != "connect" || ports.Type() != js.TypeObject || ports.Length() != 1 || !isPort(ports.Index(0)) {
+			logger.Error("wrpc: AcceptWindow: invalid handshake", logger.F("origin", origin.String()))
+			closePorts(ports)
+			return nil
+		}
+
+		port := ports.Index(0)
+		accept := false
+		once.Do(func() {
+			accept = true
+			port.Call("postMessage", map[string]interface{}{windowKey: "accept"})
+			accepted <- NewMessagePort(port)
+		})
+		if !accept {
+			port.Call("close")
+		}
+		return nil
+	})
+	defer onmessage.Release()
+
+	window.Call("addEventListener", "message", onmessage)
+	defer window.Call("removeEventListener", "message", onmessage)
+
+	select {
+	case port := <-accepted:
+		return port, nil
+	case <-ctx.Done():
+		return nil, errorx.Decorate(ctx.Err(), "no window connected")
+	}
+}
+
+// checkOrigin returns an error if origin is not an exact origin.
+func checkOrigin(origin string) error {
+	if origin == "" || origin == "*" {
+		return errorx.IllegalArgument.New("origin must be exact, got %q", origin)
+	}
+	return nil
+}
+
+// closePorts closes the transferred ports of a rejected message.
+func closePorts(ports js.Value) {
+	if ports.Type() != js.TypeObject {
+		return
+	}
+	for i := 0; i < ports.Length(); i++ {
+		if p := ports.Index(i); isPort(p) {
+			p.Call("close")
+		}
+	}
+}
@@ -4,37 +4,107 @@ package wrpc
 
 import (
 	"context"
+	"sync"
 	"syscall/js"
 
+	"github.com/joomcode/errorx"
 	"github.com/mgnsk/jsutil"
+	"github.com/mgnsk/jsutil/logger"
 )
 
-func ack(value js.Value) {
-	value.Call("postMessage", map[string]interface{}{
+// ack acknowledges a command of the main thread.
+// A non-nil err fails the command on the main thread.
+func ack(value js.Value, err error) {
+	message := map[string]interface{}{
 		"ack": true,
-	})
+	}
+	if err != nil {
+		message["error"] = err.Error()
+	}
+	value.Call("postMessage", message)
 }
 
+// linkPorts are the ports of the links that the main thread may close by ID.
+var linkPorts = struct {
+	sync.Mutex
+	ports map[int]*MessagePort
+}{ports: map[int]*MessagePort{}}
+
 // RunServer runs on the webworker side to start the server implementing the WebRPC.
-func RunServer(ctx context.Context) {
+// It blocks until ctx is done.
+func RunServer(ctx context.Context) error {
 	if !jsutil.IsWorker {
-		panic("Must have webworker environment")
+		return errorx.IllegalState.New("must have webworker environment")
 	}
 
-	jsutil.ConsoleLog("Worker started")
+	logger.Info("wrpc: worker started")
 
 	// Wait for the first message to receive the messagePort on that
 	// RPC calls from main thread are sent to.
 	onmessage := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
-		defer ack(js.Global())
+		// Every command but close_link is acknowledged,
+		// with an error when it is invalid or unknown.
+		acked := true
+		var err error
+		defer func() {
+			if acked {
+				ack(js.Global(), err)
+			}
+		}()
+		defer func() {
+			if r := recover(); r != nil {
+				err = errorx.IllegalState.New("panic handling worker message: %v", r)
+			}
+		}()
 
 		data := args[0].Get("data")
+		if data.Type() != js.TypeObject {
+			err = errorx.IllegalFormat.New("invalid worker message of type %s", data.Type().String())
+			return nil
+		}
+
+		// Close a link that the main thread failed to set up.
+		if id := data.Get("close_link"); id != js.Undefined() {
+			acked = false
+			if !isInt(id) {
+				logger.Error("wrpc: invalid link id")
+				return nil
+			}
+			linkPorts.Lock()
+			port, ok := linkPorts.ports[id.Int()]
+			linkPorts.Unlock()
+			if ok {
+				port.Close()
+			}
+			return nil
+		}
 
 		// Add the main thread port.
 		mainPort := data.Get("main_port")
 		if mainPort != js.Undefined() {
+			if !isPort(mainPort) {
+				err = errorx.IllegalArgument.New("invalid main port")
+				return nil
+			}
+
+			// Set the spawn options before the first call can arrive.
+			var opts SpawnOptions
+			if opts, err = spawnOptionsFromJS(data); err != nil {
+				err = errorx.Decorate(err, "invalid spawn options")
+				return nil
+			}
+			spawnOptions = opts
+
+			if id := data.Get("worker_id"); id.Type() == js.TypeNumber {
+				localID = id.Int()
+			}
+
 			// Set up the main port that receives commands from main thread.
-			NewMessagePort(mainPort)
+			links.add(NewMessagePort(mainPort))
+
+			if opts.ForwardOutput {
+				forwardOutput(mainPort)
+			}
 
 			return nil
 			// Not scheduling to main thread from the worker.
@@ -44,26 +114,42 @@ func RunServer(ctx context.Context) {
 		startScheduler := data.Get("start_scheduler")
 		if jsutil.IsWorker && startScheduler != js.Undefined() {
 			networkPort := data.Get("port")
+			if !isPort(networkPort) {
+				err = errorx.IllegalArgument.New("invalid scheduler port")
+				return nil
+			}
 			np := NewMessagePort(networkPort)
+			links.add(np)
+
+			if id := data.Get("link_id"); isInt(id) {
+				linkPorts.Lock()
+				linkPorts.ports[id.Int()] = np
+				linkPorts.Unlock()
+				go func() {
+					<-np.ctx.Done()
+					linkPorts.Lock()
+					delete(linkPorts.ports, id.Int())
+					linkPorts.Unlock()
+				}()
+			}
 
 			// Start scheduling to the port until the port gets closed.
 			go func() {
-				if err := GlobalScheduler.RunScheduler(np.ctx, np); err != nil {
-					jsutil.Dump("Scheduling stopped:", err)
-					panic(err)
-					// TODO
-				}
+				err := GlobalScheduler.RunScheduler(np.ctx, np)
+				logger.Debug("wrpc: scheduling stopped", logger.F("err", err))
 			}()
 
 			return nil
 		}
 
+		err = errorx.IllegalArgument.New("unknown worker message")
 		return nil
 	})
 	js.Global().Set("onmessage", onmessage)
 
 	// Notify main thread that worker started.
-	ack(js.Global())
+	ack(js.Global(), nil)
 
-	select {}
+	<-ctx.Done()
+	return ctx.Err()
 }
@@ -0,0 +1,822 @@
+// +build js,wasm
+
+package wrpc_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall/js"
+	"time"
+
+	"github.com/mgnsk/jsutil"
+	"github.com/mgnsk/jsutil/logger"
+	"github.com/mgnsk/jsutil/wrpc"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const workerCount = 2
+
+// nodeBootstrap runs the test binary in node workers.
+func nodeBootstrap() wrpc.Bootstrap {
+	argv := js.Global().Get("process").Get("argv")
+	return wrpc.Bootstrap{
+		ModuleURL:   argv.Index(2).String(),
+		WasmExecURL: path.Join(path.Dir(argv.Index(1).String()), "wasm_exec.js"),
+	}
+}
+
+// buffer is an in-memory WriteCloser.
+type buffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *buffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+func init() {
+	wrpc.Register(upper, reverse, prefix, publish, done, spawnInfo, printOutput, registerCounter, openCounter)
+}
+
+func upper(in io.Reader, out io.WriteCloser) {
+	defer out.Close()
+	b, _ := ioutil.ReadAll(in)
+	out.Write(bytes.ToUpper(b))
+}
+
+func reverse(in io.Reader, out io.WriteCloser) {
+	defer out.Close()
+	b, _ := ioutil.ReadAll(in)
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	out.Write(b)
+}
+
+func prefix(in io.Reader, out io.WriteCloser) {
+	defer out.Close()
+	out.Write([]byte("> "))
+	io.Copy(out, in)
+}
+
+func publish(in io.Reader, out io.WriteCloser) {
+	defer out.Close()
+	b, _ := ioutil.ReadAll(in)
+	wrpc.Publish("test", b)
+}
+
+func done(in io.Reader, out io.WriteCloser) {
+	defer out.Close()
+	v, _ := wrpc.SharedValue(out, "wg")
+	wg, err := wrpc.WaitGroupFromJS(v)
+	if err != nil {
+		return
+	}
+	wg.Done()
+}
+
+// startArgs and startRole are read before main runs.
+var (
+	startArgs = os.Args[1:]
+	startRole = os.Getenv("WRPC_ROLE")
+)
+
+func spawnInfo(in io.Reader, out io.WriteCloser) {
+	defer out.Close()
+	fmt.Fprintf(out, "%v %s %s", startArgs, startRole, wrpc.WorkerSpawnOptions().Config)
+}
+
+func printOutput(in io.Reader, out io.WriteCloser) {
+	defer out.Close()
+	fmt.Println("stdout line")
+	jsutil.ConsoleLog("console line")
+}
+
+// outputRecorder is an OutputSink that records the output.
+type outputRecorder struct {
+	mu     sync.Mutex
+	output map[int]string
+	logs   []string
+	ids    map[int]bool
+}
+
+func (r *outputRecorder) WriteOutput(workerID int, fd int, p []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ids[workerID] = true
+	r.output[fd] += string(p)
+}
+
+func (r *outputRecorder) Log(workerID int, entry logger.Entry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.logs = append(r.logs, entry.Msg)
+}
+
+func (r *outputRecorder) stdout() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.output[1]
+}
+
+func (r *outputRecorder) workerIDs() map[int]bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ids := map[int]bool{}
+	for id := range r.ids {
+		ids[id] = true
+	}
+	return ids
+}
+
+func (r *outputRecorder) logged() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.logs...)
+}
+
+var sink = &outputRecorder{output: map[int]string{}, ids: map[int]bool{}}
+
+// registerCounter registers a service that counts the streams opened to it.
+func registerCounter(in io.Reader, out io.WriteCloser) {
+	defer out.Close()
+	var (
+		mu    sync.Mutex
+		count int
+	)
+	name := fmt.Sprint("counter-", wrpc.WorkerID())
+	err := wrpc.RegisterService(name, func(conn io.ReadWriteCloser) {
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		mu.Lock()
+		count++
+		fmt.Fprintf(conn, "%s %s %d\n", name, strings.TrimSpace(line), count)
+		mu.Unlock()
+	})
+	if err != nil {
+		fmt.Fprint(out, err)
+	}
+}
+
+// request opens a stream to a service and returns its response to line.
+func request(conn io.ReadWriteCloser, line string) (string, error) {
+	defer conn.Close()
+	if _, err := fmt.Fprintln(conn, line); err != nil {
+		return "", err
+	}
+	return bufio.NewReader(conn).ReadString('\n')
+}
+
+// openCounter opens the counter named by the input from a worker,
+// or the counter of the first worker when the input is empty.
+func openCounter(in io.Reader, out io.WriteCloser) {
+	defer out.Close()
+	name := "counter-1"
+	if in != nil {
+		if b, _ := ioutil.ReadAll(in); len(b) > 0 {
+			name = string(b)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := wrpc.OpenService(ctx, name)
+	if err != nil {
+		fmt.Fprint(out, err)
+		return
+	}
+	resp, err := request(conn, fmt.Sprint("from-", wrpc.WorkerID()))
+	if err != nil {
+		fmt.Fprint(out, err)
+		return
+	}
+	fmt.Fprint(out, resp)
+}
+
+func wait(h *wrpc.Handle) error {
+	select {
+	case <-h.Done():
+		return h.Err()
+	case <-time.After(10 * time.Second):
+		return fmt.Errorf("timeout")
+	}
+}
+
+func spawn() (*wrpc.Worker, error) {
+	return wrpc.SpawnWorkerWith(context.Background(), wrpc.SpawnOptions{
+		Args:   []string{"worker", "-v"},
+		Env:    map[string]string{"WRPC_ROLE": "test"},
+		Config: []byte("config"),
+
+		ForwardOutput: true,
+		Sink:          sink,
+	})
+}
+
+var _ = BeforeSuite(func() {
+	wrpc.DefaultBootstrap = nodeBootstrap()
+	for i := 0; i < workerCount; i++ {
+		_, err := spawn()
+		Expect(err).To(BeNil())
+	}
+})
+
+var _ = Describe("Workers", func() {
+	It("runs a call on a worker", func() {
+		out := &buffer{}
+		Expect(wait(wrpc.Go(strings.NewReader("hello"), out, upper))).To(Succeed())
+		Expect(out.String()).To(Equal("HELLO"))
+		Expect(out.closed).To(BeTrue())
+	})
+
+	It("spawns workers with options", func() {
+		out := &buffer{}
+		Expect(wait(wrpc.Go(nil, out, spawnInfo))).To(Succeed())
+		Expect(out.String()).To(Equal("[-v] test config"))
+	})
+
+	It("forwards worker output", func() {
+		Expect(wait(wrpc.Go(nil, &buffer{}, printOutput))).To(Succeed())
+		Eventually(sink.stdout, 5*time.Second).Should(ContainSubstring("stdout line\n"))
+		Eventually(sink.logged, 5*time.Second).Should(ContainElement("console line"))
+		Expect(sink.workerIDs()).NotTo(HaveKey(0))
+	})
+
+	It("broadcasts a call to every worker", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		results := wrpc.Broadcast(ctx, upper, wrpc.BroadcastOptions{Input: []byte("all")})
+		Expect(results).To(HaveLen(len(wrpc.Workers())))
+		ids := map[int]bool{}
+		for _, r := range results {
+			Expect(r.Err).To(BeNil())
+			Expect(string(r.Output)).To(Equal("ALL"))
+			ids[r.Worker.ID()] = true
+		}
+		Expect(ids).To(HaveLen(len(results)))
+	})
+
+	It("broadcasts a call to workers that join later", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		joined := make(chan wrpc.BroadcastResult, 1)
+		wrpc.Broadcast(ctx, upper, wrpc.BroadcastOptions{
+			Input:  []byte("late"),
+			OnJoin: func(r wrpc.BroadcastResult) { joined <- r },
+		})
+
+		w, err := spawn()
+		Expect(err).To(BeNil())
+
+		var r wrpc.BroadcastResult
+		Eventually(joined, 5*time.Second).Should(Receive(&r))
+		Expect(r.Err).To(BeNil())
+		Expect(r.Worker).To(Equal(w))
+		Expect(string(r.Output)).To(Equal("LATE"))
+	})
+
+	It("opens streams to services on specific workers", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		for _, r := range wrpc.Broadcast(ctx, registerCounter, wrpc.BroadcastOptions{}) {
+			Expect(r.Err).To(BeNil())
+			Expect(r.Output).To(BeEmpty())
+		}
+
+		for _, w := range wrpc.Workers() {
+			name := fmt.Sprint("counter-", w.ID())
+			for i := 1; i <= 2; i++ {
+				conn, err := wrpc.OpenServiceOn(ctx, w.ID(), name)
+				Expect(err).To(BeNil())
+				Expect(request(conn, "main")).To(Equal(fmt.Sprintf("%s main %d\n", name, i)))
+			}
+		}
+
+		_, err := wrpc.OpenService(ctx, "counter-1")
+		Expect(err).To(BeNil())
+
+		short, cancelShort := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancelShort()
+		_, err = wrpc.OpenService(short, "missing")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("routes service streams between workers", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		for _, r := range wrpc.Broadcast(ctx, openCounter, wrpc.BroadcastOptions{}) {
+			Expect(r.Err).To(BeNil())
+			Expect(string(r.Output)).To(HavePrefix(fmt.Sprintf("counter-1 from-%d ", r.Worker.ID())))
+		}
+	})
+
+	It("links workers that are spawned concurrently", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+		defer cancel()
+
+		var (
+			wg      sync.WaitGroup
+			spawned [2]*wrpc.Worker
+			errs    [2]error
+		)
+		for i := range spawned {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				spawned[i], errs[i] = spawn()
+			}(i)
+		}
+		wg.Wait()
+		for _, err := range errs {
+			Expect(err).To(BeNil())
+		}
+
+		// Counters may already be registered on the older workers.
+		for _, r := range wrpc.Broadcast(ctx, registerCounter, wrpc.BroadcastOptions{}) {
+			Expect(r.Err).To(BeNil())
+		}
+
+		// Every worker reaches the services of both new workers.
+		for _, w := range spawned {
+			name := fmt.Sprint("counter-", w.ID())
+			for _, r := range wrpc.Broadcast(ctx, openCounter, wrpc.BroadcastOptions{Input: []byte(name)}) {
+				Expect(r.Err).To(BeNil())
+				Expect(string(r.Output)).To(HavePrefix(fmt.Sprintf("%s from-%d ", name, r.Worker.ID())))
+			}
+		}
+	})
+
+	It("fails the commands that a worker does not know", func() {
+		w := wrpc.Workers()[0]
+
+		w.JSValue().Call("postMessage", map[string]interface{}{"unknown": true})
+		var err error
+		Eventually(w.ACK(), 5*time.Second).Should(Receive(&err))
+		Expect(err).NotTo(BeNil())
+		Expect(err.Error()).To(ContainSubstring("unknown worker message"))
+
+		w.JSValue().Call("postMessage", map[string]interface{}{"start_scheduler": true, "port": 1})
+		Eventually(w.ACK(), 5*time.Second).Should(Receive(&err))
+		Expect(err).NotTo(BeNil())
+		Expect(err.Error()).To(ContainSubstring("invalid scheduler port"))
+	})
+
+	It("accepts empty input", func() {
+		out := &buffer{}
+		Expect(wait(wrpc.Go(strings.NewReader(""), out, upper))).To(Succeed())
+		Expect(out.String()).To(BeEmpty())
+	})
+
+	It("runs more calls than workers", func() {
+		var outs []*buffer
+		var handles []*wrpc.Handle
+		for i := 0; i < workerCount*3; i++ {
+			out := &buffer{}
+			outs = append(outs, out)
+			handles = append(handles, wrpc.Go(strings.NewReader(fmt.Sprint("call ", i)), out, upper))
+		}
+		for i, h := range handles {
+			Expect(wait(h)).To(Succeed())
+			Expect(outs[i].String()).To(Equal(fmt.Sprint("CALL ", i)))
+		}
+	})
+
+	It("chains calls", func() {
+		out := &buffer{}
+		Expect(wait(wrpc.GoChain(strings.NewReader("abc"), out, upper, reverse))).To(Succeed())
+		Expect(out.String()).To(Equal("CBA"))
+	})
+
+	It("maps chunks in order", func() {
+		out := &buffer{}
+		opts := wrpc.MapOptions{Ordered: true}
+		Expect(wait(wrpc.GoMap(strings.NewReader("a\nb\nc\n"), out, upper, opts))).To(Succeed())
+		Expect(out.String()).To(Equal("A\nB\nC\n"))
+	})
+
+	It("runs a graph with tee and merge", func() {
+		g := wrpc.NewGraph()
+		tee := g.Tee("tee")
+		up := g.Call("upper", upper)
+		rev := g.Call("reverse", reverse)
+		merge := g.Merge("merge")
+		g.Connect(g.Source(), tee)
+		g.Connect(tee, up)
+		g.Connect(tee, rev)
+		g.Connect(up, merge)
+		g.Connect(rev, merge)
+		g.Connect(merge, g.Sink())
+
+		out := &buffer{}
+		Expect(wait(g.Run(strings.NewReader("abc"), out))).To(Succeed())
+		Expect(out.String()).To(Equal("ABCcba"))
+	})
+
+	It("rejects an invalid graph", func() {
+		g := wrpc.NewGraph()
+		a := g.Call("a", upper)
+		b := g.Call("b", upper)
+		g.Connect(g.Source(), a)
+		g.Connect(a, b)
+		g.Connect(b, a)
+
+		err := g.Validate()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("cycle"))
+		Expect(err.Error()).To(ContainSubstring(`node "sink": unconnected input`))
+	})
+
+	It("publishes from a worker to the main thread", func() {
+		sub := wrpc.Subscribe("test", wrpc.SubscribeOptions{Buffer: 1})
+		defer sub.Close()
+
+		Expect(wait(wrpc.Go(strings.NewReader("news"), &buffer{}, publish))).To(Succeed())
+		Eventually(sub.C(), 5*time.Second).Should(Receive(Equal([]byte("news"))))
+	})
+
+	It("shares a WaitGroup with calls", func() {
+		wg, err := wrpc.NewWaitGroup()
+		Expect(err).To(BeNil())
+		wg.Add(workerCount)
+
+		opts := wrpc.CallOptions{Shared: map[string]wrpc.Shareable{"wg": wg}}
+		for i := 0; i < workerCount; i++ {
+			wrpc.GoWith(nil, &buffer{}, done, opts)
+		}
+
+		waited := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(waited)
+		}()
+		Eventually(waited, 5*time.Second).Should(BeClosed())
+	})
+})
+
+var _ = Describe("Faults", func() {
+	It("transfers the ports of calls with injected faults", func() {
+		f := wrpc.NewFaultInjector(wrpc.FaultOptions{
+			Seed:      1,
+			Kinds:     []wrpc.MessageKind{wrpc.MessageData},
+			DelayRate: 0.5,
+			MaxDelay:  time.Millisecond,
+		})
+		restore := wrpc.InjectFaults(f)
+		defer restore()
+
+		out := &buffer{}
+		Expect(wait(wrpc.Go(strings.NewReader("hello"), out, upper))).To(Succeed())
+		Expect(out.String()).To(Equal("HELLO"))
+	})
+})
+
+var _ = Describe("WebSocket session", func() {
+	var session *wrpc.Session
+
+	BeforeEach(func() {
+		session = nil
+		url := os.Getenv("WRPC_WS_URL")
+		if url == "" || js.Global().Get("WebSocket").Type() != js.TypeFunction {
+			Skip("needs a global WebSocket and WRPC_WS_URL of the loopback server in wsserver/internal/loopback")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		var err error
+		session, err = wrpc.DialWebSocket(ctx, url, nil)
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		if session != nil {
+			session.Close()
+		}
+	})
+
+	It("runs a call by name", func() {
+		out := &buffer{}
+		Expect(wait(session.Go(nil, out, "hello"))).To(Succeed())
+		Expect(out.String()).To(Equal("hello"))
+		Expect(out.closed).To(BeTrue())
+	})
+
+	It("streams input and output", func() {
+		input := strings.Repeat("abcdefgh", 64*1024)
+		out := &buffer{}
+		Expect(wait(session.Go(strings.NewReader(input), out, "upper"))).To(Succeed())
+		Expect(out.String()).To(Equal(strings.ToUpper(input)))
+	})
+
+	It("fails unknown calls", func() {
+		err := wait(session.Go(nil, &buffer{}, "missing"))
+		Expect(err).NotTo(BeNil())
+		Expect(err.Error()).To(ContainSubstring("unknown call missing"))
+	})
+})
+
+// unregistered is not registered as a remote call.
+func unregistered(in io.Reader, out io.WriteCloser) {
+	defer out.Close()
+	out.Write([]byte("ran"))
+}
+
+var _ = Describe("Message validation", func() {
+	It("fails to call an unregistered function", func() {
+		err := wait(wrpc.Go(nil, &buffer{}, unregistered))
+		Expect(err).NotTo(BeNil())
+		Expect(err.Error()).To(ContainSubstring("is not registered"))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		for _, r := range wrpc.Broadcast(ctx, unregistered, wrpc.BroadcastOptions{}) {
+			Expect(r.Err).NotTo(BeNil())
+		}
+	})
+
+	It("closes the output of a hostile call", func() {
+		w := wrpc.Workers()[0]
+		ch := js.Global().Get("MessageChannel").New()
+		out := wrpc.NewMessagePort(ch.Get("port1"))
+
+		// A made up function pointer.
+		w.MessagePort().PostMessage(map[string]interface{}{
+			"rc":     12345,
+			"output": ch.Get("port2"),
+		}, []interface{}{ch.Get("port2")})
+
+		b, err := ioutil.ReadAll(out)
+		Expect(err).To(BeNil())
+		Expect(b).To(BeEmpty())
+	})
+
+	It("fails the reader on an invalid data message", func() {
+		ch := js.Global().Get("MessageChannel").New()
+		port := wrpc.NewMessagePort(ch.Get("port1"))
+		ch.Get("port2").Call("postMessage", map[string]interface{}{"arr": "x"})
+
+		_, err := port.Read(make([]byte, 1))
+		Expect(err).NotTo(BeNil())
+		Expect(err).NotTo(Equal(io.EOF))
+	})
+
+	It("keeps serving after malformed messages", func() {
+		messages := []interface{}{
+			"x",
+			nil,
+			42,
+			map[string]interface{}{},
+			map[string]interface{}{"rc": "x"},
+			map[string]interface{}{"rc": 1.5},
+			map[string]interface{}{"rc": -1, "output": 1},
+			map[string]interface{}{"topic": "test", "msg": 5},
+			map[string]interface{}{"output": map[string]interface{}{"fd": "x"}},
+			map[string]interface{}{"log": map[string]interface{}{"level": "x"}},
+			map[string]interface{}{"hello": "x"},
+			map[string]interface{}{"service": "counter", "host": "x"},
+			map[string]interface{}{"open": "counter", "conn": "x"},
+		}
+		for _, w := range wrpc.Workers() {
+			for _, msg := range messages {
+				w.MessagePort().PostMessage(msg)
+			}
+			port := js.Global().Get("MessageChannel").New().Get("port1")
+			w.MessagePort().PostMessage(map[string]interface{}{
+				"rc":     1,
+				"output": port,
+				"input":  "x",
+			}, []interface{}{port})
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		for _, r := range wrpc.Broadcast(ctx, upper, wrpc.BroadcastOptions{Input: []byte("ok")}) {
+			Expect(r.Err).To(BeNil())
+			Expect(string(r.Output)).To(Equal("OK"))
+		}
+	})
+})
+
+// fakeWindowJS is a window that delivers the messages posted to origin
+// as if they were posted from senderOrigin. Messages are queued until a listener is added.
+const fakeWindowJS = `
+const listeners = new Set();
+const queue = [];
+const dispatch = () => {
+	if (listeners.size === 0) {
+		return;
+	}
+	while (queue.length > 0) {
+		const event = queue.shift();
+		listeners.forEach((fn) => fn(event));
+	}
+};
+return {
+	addEventListener(type, fn) {
+		if (type === "message") {
+			listeners.add(fn);
+			setTimeout(dispatch);
+		}
+	},
+	removeEventListener(type, fn) {
+		listeners.delete(fn);
+	},
+	postMessage(data, targetOrigin, transfer) {
+		if (targetOrigin !== origin) {
+			return;
+		}
+		const ports = (transfer || []).filter((p) => p instanceof MessagePort);
+		queue.push({data, origin: senderOrigin, ports});
+		setTimeout(dispatch);
+	},
+};
+`
+
+func fakeWindow(origin, senderOrigin string) js.Value {
+	return js.Global().Get("Function").New("origin", "senderOrigin", fakeWindowJS).Invoke(origin, senderOrigin)
+}
+
+var _ = Describe("Window transport", func() {
+	const (
+		appOrigin   = "https://app.test"
+		frameOrigin = "https://frame.test"
+	)
+
+	It("streams between windows", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		frame := fakeWindow(frameOrigin, appOrigin)
+		accepted := make(chan *wrpc.MessagePort, 1)
+		go func() {
+			defer GinkgoRecover()
+			port, err := wrpc.AcceptWindow(ctx, wrpc.WindowOptions{Origins: []string{appOrigin}, Window: frame})
+			Expect(err).To(BeNil())
+			accepted <- port
+		}()
+
+		app, err := wrpc.DialWindow(ctx, frame, frameOrigin)
+		Expect(err).To(BeNil())
+		var conn *wrpc.MessagePort
+		Eventually(accepted, 5*time.Second).Should(Receive(&conn))
+
+		go func() {
+			defer GinkgoRecover()
+			b, err := bufio.NewReader(conn).ReadString('\n')
+			Expect(err).To(BeNil())
+			_, err = conn.Write([]byte(strings.ToUpper(b)))
+			Expect(err).To(BeNil())
+			Expect(conn.Close()).To(Succeed())
+		}()
+
+		_, err = app.Write([]byte("ping\n"))
+		Expect(err).To(BeNil())
+		b, err := ioutil.ReadAll(app)
+		Expect(err).To(BeNil())
+		Expect(string(b)).To(Equal("PING\n"))
+	})
+
+	It("drops handshakes from other origins", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		defer cancel()
+
+		frame := fakeWindow(frameOrigin, "https://evil.test")
+		errs := make(chan error, 1)
+		go func() {
+			_, err := wrpc.AcceptWindow(ctx, wrpc.WindowOptions{Origins: []string{appOrigin}, Window: frame})
+			errs <- err
+		}()
+
+		_, err := wrpc.DialWindow(ctx, frame, frameOrigin)
+		Expect(err).NotTo(BeNil())
+		Eventually(errs, 5*time.Second).Should(Receive(HaveOccurred()))
+	})
+
+	It("posts the handshake only to the target origin", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		defer cancel()
+
+		frame := fakeWindow(frameOrigin, appOrigin)
+		go wrpc.AcceptWindow(ctx, wrpc.WindowOptions{Origins: []string{appOrigin}, Window: frame})
+
+		_, err := wrpc.DialWindow(ctx, frame, "https://other.test")
+		Expect(err).NotTo(BeNil())
+	})
+
+	It("rejects wildcard origins", func() {
+		frame := fakeWindow(frameOrigin, appOrigin)
+		_, err := wrpc.DialWindow(context.Background(), frame, "*")
+		Expect(err).NotTo(BeNil())
+		_, err = wrpc.AcceptWindow(context.Background(), wrpc.WindowOptions{Origins: []string{"*"}, Window: frame})
+		Expect(err).NotTo(BeNil())
+		_, err = wrpc.AcceptWindow(context.Background(), wrpc.WindowOptions{Window: frame})
+		Expect(err).NotTo(BeNil())
+	})
+})
+
+var _ = Describe("Tab group", func() {
+	opts := wrpc.TabOptions{Interval: 50 * time.Millisecond}
+
+	join := func(name string) *wrpc.TabGroup {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		g, err := wrpc.JoinTabs(ctx, name, opts)
+		Expect(err).To(BeNil())
+		return g
+	}
+
+	It("elects the oldest tab", func() {
+		leader := join("elect")
+		defer leader.Close()
+		follower := join("elect")
+		defer follower.Close()
+
+		Expect(leader.IsLeader()).To(BeTrue())
+		Expect(follower.IsLeader()).To(BeFalse())
+		Expect(follower.Leader()).To(Equal(leader.ID()))
+	})
+
+	It("forwards calls to the leader", func() {
+		leader := join("forward")
+		defer leader.Close()
+		follower := join("forward")
+		defer follower.Close()
+
+		out := &buffer{}
+		Expect(wait(follower.Go(strings.NewReader("from a tab"), out, upper))).To(Succeed())
+		Expect(out.String()).To(Equal("FROM A TAB"))
+		Expect(out.closed).To(BeTrue())
+
+		out = &buffer{}
+		Expect(wait(follower.Go(nil, out, spawnInfo))).To(Succeed())
+		Expect(out.String()).To(Equal("[-v] test config"))
+	})
+
+	It("fails unregistered calls", func() {
+		leader := join("unregistered")
+		defer leader.Close()
+		follower := join("unregistered")
+		defer follower.Close()
+
+		err := wait(follower.Go(nil, &buffer{}, unregistered))
+		Expect(err).NotTo(BeNil())
+		Expect(err.Error()).To(ContainSubstring("is not registered"))
+	})
+
+	It("elects a new leader when the leader leaves", func() {
+		leader := join("failover")
+		follower := join("failover")
+		defer follower.Close()
+
+		changed := follower.LeaderChanged()
+		Expect(leader.Close()).To(Succeed())
+		Eventually(changed, 5*time.Second).Should(BeClosed())
+		Expect(follower.IsLeader()).To(BeTrue())
+
+		out := &buffer{}
+		Expect(wait(follower.Go(strings.NewReader("alone"), out, upper))).To(Succeed())
+		Expect(out.String()).To(Equal("ALONE"))
+	})
+
+	It("closes once when closed concurrently", func() {
+		g := join("close")
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				Expect(g.Close()).To(Succeed())
+			}()
+		}
+		wg.Wait()
+	})
+})
+
+var _ = Describe("Shared worker", func() {
+	It("requires SharedWorker support", func() {
+		_, err := wrpc.ConnectSharedWorker(context.Background(), "shared.js", "wrpc")
+		Expect(err).NotTo(BeNil())
+		Expect(wrpc.InSharedWorker()).To(BeFalse())
+		Expect(wrpc.RunSharedServer(context.Background())).NotTo(Succeed())
+	})
+
+	It("generates the shared worker script", func() {
+		source := string(nodeBootstrap().SharedWorkerSource())
+		Expect(source).To(ContainSubstring("self.onconnect"))
+		Expect(source).To(ContainSubstring("importScripts"))
+	})
+})
@@ -0,0 +1,48 @@
+// Command loopback serves the calls of the wrpc js tests on a loopback address.
+// It prints the WebSocket URL of the server and serves until it is killed.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/mgnsk/jsutil/wrpc/wsserver"
+)
+
+func upper(in io.Reader, out io.WriteCloser) {
+	defer out.Close()
+	b, _ := ioutil.ReadAll(in)
+	out.Write(bytes.ToUpper(b))
+}
+
+func hello(in io.Reader, out io.WriteCloser) {
+	defer out.Close()
+	out.Write([]byte("hello"))
+}
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:0", "loopback address to listen on")
+	flag.Parse()
+
+	server := wsserver.New()
+	// Node does not send an origin.
+	server.AllowAnyOrigin = true
+	for name, f := range map[string]func(io.Reader, io.WriteCloser){"upper": upper, "hello": hello} {
+		if err := server.Register(name, f); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("ws://%s/\n", ln.Addr())
+	log.Fatal(http.Serve(ln, server))
+}
@@ -0,0 +1,161 @@
+// Package wsserver serves wrpc calls to browsers over WebSocket from a native Go process.
+//
+// Calls are registered by name since function pointers differ between
+// the wasm and the native binary. A wasm client connects with wrpc.DialWebSocket,
+// a native client with Dial.
+package wsserver
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/joomcode/errorx"
+	"github.com/mgnsk/jsutil/logger"
+	"github.com/mgnsk/jsutil/wrpc"
+	"golang.org/x/net/websocket"
+)
+
+// Server is an http.Handler that runs a wrpc session on each WebSocket.
+type Server struct {
+	// Origins are the exact origins that may connect, such as "https://example.com".
+	// When empty, no origin is accepted unless AllowAnyOrigin is set.
+	Origins []string
+	// AllowAnyOrigin accepts every origin and requests without one.
+	// Any web page can then run the registered calls through the browser of a user,
+	// so only set it for servers that are not reachable from browsers.
+	AllowAnyOrigin bool
+
+	mu    sync.RWMutex
+	calls map[string]wrpc.RemoteCall
+}
+
+// New creates a server without calls.
+func New() *Server {
+	return &Server{calls: map[string]wrpc.RemoteCall{}}
+}
+
+// Register makes f callable by name.
+// Sessions that are already open do not see it.
+func (s *Server) Register(name string, f wrpc.RemoteCall) error {
+	if f == nil {
+		return errorx.IllegalArgument.New("call %s: nil function", name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.calls[name]; ok {
+		return errorx.IllegalState.New("call %s is already registered", name)
+	}
+	s.calls[name] = f
+	return nil
+}
+
+// ServeHTTP upgrades the request to a WebSocket and serves it until it is closed.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ws := websocket.Server{
+		Handshake: s.handshake,
+		Handler:   s.serve,
+	}
+	ws.ServeHTTP(w, r)
+}
+
+func (s *Server) handshake(config *websocket.Config, r *http.Request) error {
+	origin, err := websocket.Origin(config, r)
+	if err != nil {
+		return err
+	}
+	config.Origin = origin
+	if s.AllowAnyOrigin {
+		return nil
+	}
+	if origin != nil {
+		for _, allowed := range s.Origins {
+			if origin.Scheme+"://"+origin.Host == allowed {
+				return nil
+			}
+		}
+	}
+	return errorx.IllegalArgument.New("origin %v is not allowed", origin)
+}
+
+func (s *Server) serve(ws *websocket.Conn) {
+	s.mu.RLock()
+	calls := make(map[string]wrpc.RemoteCall, len(s.calls))
+	for name, f := range s.calls {
+		calls[name] = f
+	}
+	s.mu.RUnlock()
+
+	session := wrpc.NewSession(NewFrameConn(ws), calls)
+	<-session.Done()
+	logger.Debug("wsserver: session ended", logger.F("err", session.Err()))
+}
+
+// Dial opens a session to a Server at rawurl, such as "ws://localhost:8080/wrpc".
+// Only the ws scheme is supported.
+// The other end may run calls by name. calls may be nil.
+func Dial(ctx context.Context, rawurl string, calls map[string]wrpc.RemoteCall) (*wrpc.Session, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, errorx.Decorate(err, "invalid url %s", rawurl)
+	}
+	if u.Scheme != "ws" {
+		return nil, errorx.NotImplemented.New("unsupported scheme %s", u.Scheme)
+	}
+	origin := &url.URL{Scheme: "http", Host: u.Host}
+
+	config, err := websocket.NewConfig(rawurl, origin.String())
+	if err != nil {
+		return nil, errorx.Decorate(err, "invalid url %s", rawurl)
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", hostPort(u))
+	if err != nil {
+		return nil, errorx.Decorate(err, "error dialing %s", rawurl)
+	}
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		conn.Close()
+		return nil, errorx.Decorate(err, "error opening WebSocket %s", rawurl)
+	}
+
+	return wrpc.NewSession(NewFrameConn(ws), calls), nil
+}
+
+// hostPort returns the address of u with the default port of ws.
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+// frameConn is a FrameConn over a WebSocket with binary frames.
+type frameConn struct {
+	ws *websocket.Conn
+}
+
+// NewFrameConn returns a FrameConn over ws.
+func NewFrameConn(ws *websocket.Conn) wrpc.FrameConn {
+	ws.PayloadType = websocket.BinaryFrame
+	return &frameConn{ws: ws}
+}
+
+func (c *frameConn) ReadFrame() ([]byte, error) {
+	var frame []byte
+	if err := websocket.Message.Receive(c.ws, &frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+func (c *frameConn) WriteFrame(frame []byte) error {
+	return websocket.Message.Send(c.ws, frame)
+}
+
+func (c *frameConn) Close() error {
+	return c.ws.Close()
+}
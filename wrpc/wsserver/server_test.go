@@ -0,0 +1,168 @@
+// +build !js !wasm
+
+package wsserver_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/mgnsk/jsutil/wrpc"
+	"github.com/mgnsk/jsutil/wrpc/wsserver"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// buffer is an in-memory WriteCloser.
+type buffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *buffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+func upper(in io.Reader, out io.WriteCloser) {
+	defer out.Close()
+	b, _ := ioutil.ReadAll(in)
+	out.Write(bytes.ToUpper(b))
+}
+
+func hello(in io.Reader, out io.WriteCloser) {
+	defer out.Close()
+	out.Write([]byte("hello"))
+}
+
+func crash(in io.Reader, out io.WriteCloser) {
+	panic("crash")
+}
+
+func wait(h *wrpc.Handle) error {
+	select {
+	case <-h.Done():
+		return h.Err()
+	case <-time.After(10 * time.Second):
+		return fmt.Errorf("timeout")
+	}
+}
+
+var _ = Describe("Server", func() {
+	var (
+		server  *wsserver.Server
+		ts      *httptest.Server
+		session *wrpc.Session
+	)
+
+	dial := func() (*wrpc.Session, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return wsserver.Dial(ctx, "ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	}
+
+	BeforeEach(func() {
+		server = wsserver.New()
+		Expect(server.Register("upper", upper)).To(Succeed())
+		Expect(server.Register("hello", hello)).To(Succeed())
+		Expect(server.Register("crash", crash)).To(Succeed())
+		ts = httptest.NewServer(server)
+		server.Origins = []string{ts.URL}
+
+		var err error
+		session, err = dial()
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		session.Close()
+		ts.Close()
+	})
+
+	It("runs a call by name", func() {
+		out := &buffer{}
+		Expect(wait(session.Go(strings.NewReader("over the wire"), out, "upper"))).To(Succeed())
+		Expect(out.String()).To(Equal("OVER THE WIRE"))
+		Expect(out.closed).To(BeTrue())
+	})
+
+	It("runs a call without input", func() {
+		out := &buffer{}
+		Expect(wait(session.Go(nil, out, "hello"))).To(Succeed())
+		Expect(out.String()).To(Equal("hello"))
+	})
+
+	It("streams large input in chunks", func() {
+		input := strings.Repeat("abcdefgh", 64*1024)
+		out := &buffer{}
+		Expect(wait(session.Go(strings.NewReader(input), out, "upper"))).To(Succeed())
+		Expect(out.String()).To(Equal(strings.ToUpper(input)))
+	})
+
+	It("runs concurrent calls", func() {
+		var outs []*buffer
+		var handles []*wrpc.Handle
+		for i := 0; i < 10; i++ {
+			out := &buffer{}
+			outs = append(outs, out)
+			handles = append(handles, session.Go(strings.NewReader(fmt.Sprint("call ", i)), out, "upper"))
+		}
+		for i, h := range handles {
+			Expect(wait(h)).To(Succeed())
+			Expect(outs[i].String()).To(Equal(fmt.Sprint("CALL ", i)))
+		}
+	})
+
+	It("fails unknown calls", func() {
+		err := wait(session.Go(nil, &buffer{}, "missing"))
+		Expect(err).NotTo(BeNil())
+		Expect(err.Error()).To(ContainSubstring("unknown call missing"))
+	})
+
+	It("fails calls that panic", func() {
+		err := wait(session.Go(nil, &buffer{}, "crash"))
+		Expect(err).NotTo(BeNil())
+		Expect(err.Error()).To(ContainSubstring("panicked"))
+
+		out := &buffer{}
+		Expect(wait(session.Go(nil, out, "hello"))).To(Succeed())
+	})
+
+	It("fails calls after the session is closed", func() {
+		Expect(session.Close()).To(Succeed())
+		Eventually(session.Done(), 5*time.Second).Should(BeClosed())
+
+		err := wait(session.Go(nil, &buffer{}, "hello"))
+		Expect(err).NotTo(BeNil())
+	})
+
+	It("rejects other origins", func() {
+		server.Origins = []string{"https://app.test"}
+		_, err := dial()
+		Expect(err).NotTo(BeNil())
+
+		server.Origins = []string{ts.URL}
+		s, err := dial()
+		Expect(err).To(BeNil())
+		s.Close()
+	})
+
+	It("rejects every origin by default", func() {
+		server.Origins = nil
+		_, err := dial()
+		Expect(err).NotTo(BeNil())
+	})
+
+	It("accepts any origin when allowed", func() {
+		server.Origins = []string{"https://app.test"}
+		server.AllowAnyOrigin = true
+		s, err := dial()
+		Expect(err).To(BeNil())
+		s.Close()
+	})
+})
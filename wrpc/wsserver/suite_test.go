@@ -0,0 +1,15 @@
+// +build !js !wasm
+
+package wsserver_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestWSServer(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "wsserver")
+}